@@ -0,0 +1,261 @@
+package avx512gen
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/arch/x86/x86csv"
+)
+
+// ArgStrategy selects operands that are used to cover instruction forms.
+type ArgStrategy interface {
+	// InstArgs returns operands that cover arg, which is a single
+	// x86.csv operand of inst in Intel syntax, like "zmm2/m512/m64bcst".
+	//
+	// Tests are generated for every combination of the operands
+	// returned for all inst operands.
+	InstArgs(inst *x86csv.Inst, arg string) ([]Arg, error)
+}
+
+// ArgTable is a table-driven ArgStrategy.
+//
+// Operands for every syntax are taken from Args in a round-robin manner,
+// so different instructions get different operands.
+// Because of that, ArgTable is stateful and should not be shared
+// between concurrent Generate calls.
+type ArgTable struct {
+	// Args maps normalized operand syntax to a list
+	// of operands that can be used to cover it.
+	Args map[string][]Arg
+
+	// Peeks maps normalized operand syntax to a number of
+	// operands that are taken from Args for a single instruction.
+	Peeks map[string]int
+
+	// Normalize maps x86.csv operand syntax to Args key.
+	Normalize map[string]string
+
+	// VMemWidths maps Intel opcode to VSIB memory operand element width.
+	VMemWidths map[string]uint16
+
+	peeks map[string]int
+
+	// dropped holds syntaxes that have no operands
+	// that are valid in the table machine mode (see ForMode).
+	dropped map[string]bool
+}
+
+// errNoModeArgs is returned by ArgTable.InstArgs for the operand syntax
+// that has no operands that are valid in the table machine mode.
+var errNoModeArgs = errors.New("no operands are valid in this mode")
+
+// NewArgTable returns ArgTable that is initialized with the built-in tables.
+func NewArgTable() *ArgTable {
+	return &ArgTable{
+		Args:       instArgsBySyntax,
+		Peeks:      peeksPerArgBySyntax,
+		Normalize:  argNormalizeMap,
+		VMemWidths: vmemWidths,
+	}
+}
+
+// InstArgs implements ArgStrategy interface.
+func (table *ArgTable) InstArgs(inst *x86csv.Inst, arg string) ([]Arg, error) {
+	if table.peeks == nil {
+		table.peeks = map[string]int{}
+	}
+
+	arg = table.normalizeArg(inst, arg)
+
+	if table.dropped[arg] {
+		return nil, fmt.Errorf("%s: %w", arg, errNoModeArgs)
+	}
+
+	if arglist := table.Args[arg]; arglist != nil {
+		npeeks, ok := table.Peeks[arg]
+		if !ok {
+			return nil, fmt.Errorf("undefined npeeks for %q", arg)
+		}
+
+		ret := make([]Arg, npeeks)
+		i := table.peeks[arg]
+		for j := 0; j < npeeks; j++ {
+			ret[j] = arglist[i]
+			i++
+			if i >= len(arglist) {
+				i = 0
+			}
+		}
+		table.peeks[arg] = i
+
+		return ret, nil
+	}
+
+	switch arg {
+	case "{k}{z}", "{k1-k7}":
+		// Ignore zeroing.
+		return table.InstArgs(inst, "{k}")
+	case "r/m32":
+		return table.instArgsList(inst, "rmr32", "m32")
+	case "r/m64":
+		return table.instArgsList(inst, "rmr64", "m64")
+	default:
+		if strings.Contains(arg, "/m") {
+			return table.instArgsList(inst, strings.Split(arg, "/")...)
+		}
+		return nil, fmt.Errorf("unhandled %q arg", arg)
+	}
+}
+
+func (table *ArgTable) instArgsList(inst *x86csv.Inst, args ...string) ([]Arg, error) {
+	var parsed []Arg
+	var noModeArgs error
+	for _, arg := range args {
+		list, err := table.InstArgs(inst, arg)
+		if errors.Is(err, errNoModeArgs) {
+			// Other alternatives, like memory operands, can still be covered.
+			noModeArgs = err
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, list...)
+	}
+	if len(parsed) == 0 && noModeArgs != nil {
+		return nil, noModeArgs
+	}
+	return parsed, nil
+}
+
+func (table *ArgTable) normalizeArg(inst *x86csv.Inst, arg string) string {
+	arg = argReplacer.Replace(arg)
+	if normalized := table.Normalize[arg]; normalized != "" {
+		switch normalized {
+		case "vmx", "vmy", "vmz":
+			if width := table.VMemWidths[inst.IntelOpcode()]; width != 0 {
+				return fmt.Sprintf("%s:%d", normalized, width)
+			}
+		}
+		return normalized
+	}
+
+	return arg
+}
+
+// ForMode returns a table with operands that are valid in the given mode.
+//
+// Mode64 tables are returned as is. For other modes, register operands
+// that can't be encoded are removed (register blocks, like "zmm+3",
+// should fit entirely) and peeks are limited by the number of remaining
+// operands. Syntaxes that are left without operands are removed from Args
+// and Peeks; InstArgs reports them with an error, so instructions that
+// need them are skipped explicitly. Memory operands are converted instead: address registers are
+// replaced by 32-bit registers with the same low 3 bits of the number
+// (R15 becomes EDI, XMM29 becomes XMM5), so memory forms are still covered.
+func (table *ArgTable) ForMode(mode MachineMode) *ArgTable {
+	if mode == Mode64 {
+		return table
+	}
+
+	result := &ArgTable{
+		Args:       make(map[string][]Arg, len(table.Args)),
+		Peeks:      make(map[string]int, len(table.Peeks)),
+		Normalize:  table.Normalize,
+		VMemWidths: table.VMemWidths,
+		dropped:    map[string]bool{},
+	}
+	for syntax, args := range table.Args {
+		list := []Arg{}
+		for _, arg := range args {
+			if arg, ok := mode32Arg(arg, regBlockSize(syntax)); ok {
+				list = append(list, arg)
+			}
+		}
+		if len(args) != 0 && len(list) == 0 {
+			result.dropped[syntax] = true
+			continue
+		}
+		result.Args[syntax] = list
+	}
+	for syntax, npeeks := range table.Peeks {
+		if result.dropped[syntax] {
+			continue
+		}
+		if args, ok := result.Args[syntax]; ok && npeeks > len(args) {
+			npeeks = len(args)
+		}
+		result.Peeks[syntax] = npeeks
+	}
+	return result
+}
+
+// regBlockSize returns N for register block syntax, like "zmm+3".
+// Returns 0 for other operands.
+func regBlockSize(syntax string) int {
+	i := strings.LastIndexByte(syntax, '+')
+	if i == -1 {
+		return 0
+	}
+	n, err := strconv.Atoi(syntax[i+1:])
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// mode32Arg converts arg to the form that is valid in 32-bit mode.
+// Returns false if arg should be dropped.
+func mode32Arg(arg Arg, block int) (Arg, bool) {
+	switch data := arg.Data.(type) {
+	case *RegArgument:
+		return arg, mode32Reg(data.Name, block)
+	case *MemArgument:
+		mem := *data
+		mem.Base = mode32AddrReg(mem.Base)
+		mem.Index = mode32AddrReg(mem.Index)
+		return Arg{GoSyntax: memoryExpression(&mem), Data: &mem}, true
+	default:
+		return arg, true
+	}
+}
+
+var gpr32Names = []string{"EAX", "ECX", "EDX", "EBX", "ESP", "EBP", "ESI", "EDI"}
+
+// mode32Reg reports whether register name (and block more
+// registers after it) can be encoded in 32-bit mode.
+func mode32Reg(name string, block int) bool {
+	if isVectorReg(name) {
+		n, err := strconv.Atoi(name[len("XMM"):])
+		return err == nil && n+block <= 7
+	}
+	for _, gpr := range gpr32Names {
+		if name == gpr {
+			return true
+		}
+	}
+	return strings.HasPrefix(name, "K") && len(name) == 2
+}
+
+// mode32AddrReg maps address register name to the 32-bit register
+// with the same low 3 bits of the number.
+func mode32AddrReg(name string) string {
+	if isVectorReg(name) {
+		n, err := strconv.Atoi(name[len("XMM"):])
+		if err != nil {
+			return name
+		}
+		return fmt.Sprintf("%s%d", name[:len("XMM")], n%8)
+	}
+	for i, gpr := range gpr32Names {
+		if name == "R"+gpr[1:] {
+			return gpr
+		}
+		if name == fmt.Sprintf("R%d", i+8) || name == fmt.Sprintf("R%dD", i+8) {
+			return gpr
+		}
+	}
+	return name
+}
@@ -1,75 +1,80 @@
-package main
+package avx512gen
 
 import (
 	"fmt"
 	"strings"
 
 	"github.com/quasilyte/avx512test/internal/x86encode"
-	"golang.org/x/arch/x86/x86csv"
 )
 
 // This file acts as a configuration.
 // The output depends on this file contents directly.
+// These tables are used by default; LoadArgTable can override them.
 
 // TODO(quasilyte): less hardcoded options. Generate programmatically.
 // What we trying to do here looks like property-based testing,
 // but without an appropriate framework.
 
-type instArg struct {
-	goSyntax string
-	data     x86encode.Argument
+// Arg is an instruction operand that is used to generate tests.
+type Arg struct {
+	// GoSyntax is an operand string in Go asm syntax, like "Z25" or "$7".
+	GoSyntax string
+
+	// Data is an operand description for the encoder.
+	Data Argument
 }
 
 // instArgsBySyntax maps x86csv operand syntax string to a list
 // of appropriate arguments that can be used to cover it.
 //
 // Initialized inside init().
-var instArgsBySyntax map[string][]instArg
+var instArgsBySyntax map[string][]Arg
 
 func init() {
 	type mem = x86encode.MemArgument
 	type imm = x86encode.ImmArgument
 	type reg = x86encode.RegArgument
+	type rel = x86encode.RelArgument
 
-	makeRegArgs := func(name, goFmt, xedFmt string, ids ...int) []instArg {
-		args := make([]instArg, len(ids))
+	makeRegArgs := func(name, goFmt, xedFmt string, ids ...int) []Arg {
+		args := make([]Arg, len(ids))
 		for i, id := range ids {
 			goSyntax := fmt.Sprintf(goFmt, name, id)
 			data := &reg{Name: fmt.Sprintf(xedFmt, name, id)}
-			args[i] = instArg{goSyntax, data}
+			args[i] = Arg{goSyntax, data}
 		}
 		return args
 	}
 
-	makeMaskRegArgs := func(ids ...int) []instArg {
+	makeMaskRegArgs := func(ids ...int) []Arg {
 		return makeRegArgs("K", "%s%d", "%s%d", ids...)
 	}
 
-	makeVecRegArgs := func(name string, ids ...int) []instArg {
+	makeVecRegArgs := func(name string, ids ...int) []Arg {
 		return makeRegArgs(name, "%s%d", "%sMM%d", ids...)
 	}
 
-	makeUint8Args := func(values ...uint64) []instArg {
-		args := make([]instArg, len(values))
+	makeUint8Args := func(values ...uint64) []Arg {
+		args := make([]Arg, len(values))
 		for i, v := range values {
 			goSyntax := fmt.Sprintf("$%d", v)
 			data := &imm{Width: 8, Value: v, Unsigned: true}
-			args[i] = instArg{goSyntax, data}
+			args[i] = Arg{goSyntax, data}
 		}
 		return args
 	}
 
-	memoryListToArgs := func(width uint, list []*mem) []instArg {
-		args := make([]instArg, len(list))
+	memoryListToArgs := func(width uint, list []*mem) []Arg {
+		args := make([]Arg, len(list))
 		for i, mem := range list {
 			mem.Width = width
-			args[i].goSyntax = memoryExpression(mem)
-			args[i].data = mem
+			args[i].GoSyntax = memoryExpression(mem)
+			args[i].Data = mem
 		}
 		return args
 	}
 
-	makeMemArgs := func(width uint) []instArg {
+	makeMemArgs := func(width uint) []Arg {
 		return memoryListToArgs(width, []*mem{
 			{Base: "RSP", Disp: 17},
 			{Base: "RBP", Index: "RSI", Scale: 4, Disp: -17},
@@ -136,7 +141,7 @@ func init() {
 		})
 	}
 
-	makeVMemXArgs := func(width uint) []instArg {
+	makeVMemXArgs := func(width uint) []Arg {
 		return memoryListToArgs(width, []*mem{
 			{Base: "RAX", Index: "XMM4"},
 			{Base: "RBP", Index: "XMM10", Scale: 2},
@@ -146,7 +151,7 @@ func init() {
 			{Base: "R14", Index: "XMM29", Scale: 8},
 		})
 	}
-	makeVMemYArgs := func(width uint) []instArg {
+	makeVMemYArgs := func(width uint) []Arg {
 		return memoryListToArgs(width, []*mem{
 			{Base: "RAX", Index: "YMM3"},
 			{Base: "RBP", Index: "YMM9", Scale: 2},
@@ -156,7 +161,7 @@ func init() {
 			{Base: "R14", Index: "YMM28", Scale: 8},
 		})
 	}
-	makeVMemZArgs := func(width uint) []instArg {
+	makeVMemZArgs := func(width uint) []Arg {
 		return memoryListToArgs(width, []*mem{
 			{Base: "RAX", Index: "ZMM9"},
 			{Base: "RBP", Index: "ZMM12", Scale: 2},
@@ -167,7 +172,7 @@ func init() {
 		})
 	}
 
-	instArgsBySyntax = map[string][]instArg{
+	instArgsBySyntax = map[string][]Arg{
 		// Skip broadcasts.
 		// They are tested separately (as all other suffixes).
 		"m32bcst": {},
@@ -516,6 +521,12 @@ func init() {
 			6, 2,
 		),
 
+		// Branch targets (see Config.Branches).
+		// Writers define labels right after the branch,
+		// so the encoded displacement is 0 (see TestLine.Label).
+		"rel8":  {{"rel8_target", &rel{Width: 8, Label: "rel8_target"}}},
+		"rel32": {{"rel32_target", &rel{Width: 32, Label: "rel32_target"}}},
+
 		// End of instArgsBySyntax literal.
 	}
 }
@@ -558,6 +569,9 @@ var peeksPerArgBySyntax = map[string]int{
 
 	"m32bcst": 0,
 	"m64bcst": 0,
+
+	"rel8":  1,
+	"rel32": 1,
 }
 
 // argReplacer is used to erase/replace arguments before parsing them.
@@ -637,29 +651,14 @@ var vmemWidths = map[string]uint16{
 	"VSCATTERPF1QPS": 8,
 }
 
-func normalizeArg(inst *x86csv.Inst, arg string) string {
-	arg = argReplacer.Replace(arg)
-	if normalized := argNormalizeMap[arg]; normalized != "" {
-		switch normalized {
-		case "vmx", "vmy", "vmz":
-			if width := vmemWidths[inst.IntelOpcode()]; width != 0 {
-				return fmt.Sprintf("%s:%d", normalized, width)
-			}
-		}
-		return normalized
-	}
-
-	return arg
-}
-
-func argsCartesianProd(args [][]instArg) (c [][]instArg) {
+func argsCartesianProd(args [][]Arg) (c [][]Arg) {
 	if len(args) == 0 {
-		return [][]instArg{nil}
+		return [][]Arg{nil}
 	}
 	c2 := argsCartesianProd(args[1:])
 	for _, arg := range args[0] {
 		for _, rest := range c2 {
-			c = append(c, append([]instArg{arg}, rest...))
+			c = append(c, append([]Arg{arg}, rest...))
 		}
 	}
 	return c
@@ -0,0 +1,729 @@
+// Package avx512gen generates AVX-512 assembler tests.
+// Relative branch instructions can be covered too (see Config.Branches).
+//
+// Instructions are taken from x86.csv, operands are picked by ArgStrategy
+// and every instruction form is encoded with Encoder (Intel XED by default).
+// Generated tests can be rendered by one of the Writer implementations.
+package avx512gen
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/quasilyte/avx512test/internal/x86encode"
+	"golang.org/x/arch/x86/x86csv"
+)
+
+// Encoder is an instruction encoder backend.
+type Encoder = x86encode.Encoder
+
+// MachineMode is a CPU operating mode tests are generated for.
+type MachineMode = x86encode.MachineMode
+
+// Machine modes that are supported by the generator.
+const (
+	Mode64 = x86encode.Mode64
+	Mode32 = x86encode.Mode32
+)
+
+// Operand descriptions that are passed to the encoder.
+type (
+	Argument    = x86encode.Argument
+	RegArgument = x86encode.RegArgument
+	ImmArgument = x86encode.ImmArgument
+	MemArgument = x86encode.MemArgument
+	RelArgument = x86encode.RelArgument
+	PtrArgument = x86encode.PtrArgument
+)
+
+// Config describes tests generation.
+type Config struct {
+	// Source provides instructions to generate tests for.
+	// Only AVX-512 instructions that are valid in Mode are used,
+	// unless Branches is set.
+	Source InstSource
+
+	// Mode is a machine mode tests are generated for:
+	// Mode64 (default) or Mode32.
+	Mode MachineMode
+
+	// Branches enables tests for relative branch instruction forms,
+	// like "JMP rel8" or "CALL rel32". Branch targets are symbolic
+	// labels (see the "rel8" and "rel32" built-in args) that are
+	// numbered to be unique (see TestLine.Label).
+	// These tests are written to the "branch" file.
+	Branches bool
+
+	// Args selects instruction operands.
+	// If nil, NewArgTable().ForMode(Mode) is used.
+	//
+	// Args should only return operands that are valid in Mode.
+	Args ArgStrategy
+
+	// Encoder encodes instruction forms.
+	// If nil, XED encoder for Mode is used.
+	//
+	// Iform is only recorded for encoders that implement
+	// x86encode.Describer or x86encode.BatchDescriber.
+	Encoder Encoder
+
+	// Jobs is a number of goroutines that encode instruction forms.
+	// Values less than 2 mean that everything is encoded by
+	// the calling goroutine.
+	//
+	// Generated tests do not depend on Jobs: operands are selected
+	// before the encoding starts and the results are collected in
+	// the same order as for the sequential run.
+	// Only Encoder is used concurrently, so it should be
+	// safe for concurrent use if Jobs is greater than 1.
+	Jobs int
+
+	// OnFailure is called for every instruction form that was
+	// rejected by the encoder. Optional.
+	//
+	// OnFailure and Debugf are always called from
+	// the goroutine that runs Generate.
+	OnFailure func(*Failure)
+
+	// Debugf is called for debug messages. Optional.
+	Debugf func(format string, args ...interface{})
+}
+
+func (cfg *Config) debugf(format string, args ...interface{}) {
+	if cfg.Debugf != nil {
+		cfg.Debugf(format, args...)
+	}
+}
+
+func (cfg *Config) addFailure(f *Failure) {
+	if cfg.OnFailure != nil {
+		cfg.OnFailure(f)
+	}
+}
+
+// TestLine is a single generated test.
+type TestLine struct {
+	Asm   string // Asm string in Go syntax
+	Enc   string // Encoding string, can contain several or-separated encodings
+	CPUID string // Normalized CPUID
+
+	Filename string // Output file name, derived from CPUID
+
+	Intel     string       // Asm string in Intel syntax
+	GNU       string       // Asm string in GNU as syntax
+	Objdump   string       // GNU syntax, as printed by objdump
+	Encodings []*Encoding  // All encodings that form Enc
+	Inst      *x86csv.Inst // x86.csv row this test was generated from
+
+	// Label is a branch target label that should be defined right
+	// after the test instruction, like "rel8_target_1".
+	// Empty for non-branch tests.
+	Label string
+}
+
+// HasEncoding reports whether hex is one of the test encodings.
+func (test *TestLine) HasEncoding(hex string) bool {
+	for _, enc := range test.Encodings {
+		if enc.Hex == hex {
+			return true
+		}
+	}
+	return false
+}
+
+// Relaxable reports whether test is a rel32 form of a branch
+// that also has a rel8 form, like "JMP rel32".
+// Assemblers pick the short form for such branches,
+// unless the long form is forced (like with {disp32} prefix).
+func (test *TestLine) Relaxable() bool {
+	return test.Label != "" && test.Inst.IntelArgs()[0] == "rel32" &&
+		strings.HasPrefix(test.Inst.IntelOpcode(), "J")
+}
+
+// Encoding describes a single encoding of the test line.
+type Encoding struct {
+	Hex   string `json:"hex"`
+	Iform string `json:"iform,omitempty"`
+	VL    int    `json:"vl,omitempty"`
+	W     int    `json:"w"`
+
+	// Source is an encoding origin. Empty for XED encodings.
+	Source string `json:"source,omitempty"`
+}
+
+// Generate returns tests for all instructions from cfg.Source.
+// Tests are sorted by Go syntax asm string.
+func Generate(cfg *Config) ([]*TestLine, error) {
+	if cfg.Mode != Mode64 && cfg.Mode != Mode32 {
+		return nil, fmt.Errorf("unsupported %d-bit mode", cfg.Mode.Bits())
+	}
+	insts, err := cfg.Source.Insts()
+	if err != nil {
+		return nil, err
+	}
+
+	g := &generator{
+		cfg:           cfg,
+		args:          cfg.Args,
+		encoder:       cfg.Encoder,
+		testLineByAsm: map[string]*TestLine{},
+	}
+	if g.args == nil {
+		g.args = NewArgTable().ForMode(cfg.Mode)
+	}
+	if g.encoder == nil {
+		encoder, err := x86encode.New(x86encode.Options{Mode: cfg.Mode})
+		if err != nil {
+			return nil, err
+		}
+		g.encoder = encoder
+	}
+
+	// Operands selection is stateful (see ArgTable),
+	// so all jobs are collected before the fan-out.
+	filtered := filterInsts(insts, cfg.Mode)
+	if cfg.Branches {
+		filtered = append(filtered, filterBranchInsts(insts, cfg.Mode)...)
+	}
+	var jobs []*testJob
+	for _, inst := range filtered {
+		instJobs, err := g.instJobs(inst)
+		if err != nil {
+			return nil, fmt.Errorf("generate tests: %s: %v", inst.Go, err)
+		}
+		jobs = append(jobs, instJobs...)
+	}
+
+	g.encodeJobs(jobs)
+
+	for _, job := range jobs {
+		if err := g.addTestLine(job); err != nil {
+			return nil, fmt.Errorf("generate tests: %s: %v", job.inst.Go, err)
+		}
+	}
+
+	tests := make([]*TestLine, 0, len(g.testLineByAsm))
+	for _, test := range g.testLineByAsm {
+		tests = append(tests, test)
+	}
+	sort.Slice(tests, func(i, j int) bool {
+		return tests[i].Asm < tests[j].Asm
+	})
+	numberLabels(tests)
+
+	return tests, nil
+}
+
+// numberLabels makes branch target labels unique by adding
+// the test number to them, so "JMP rel8_target" becomes
+// "JMP rel8_target_1". Tests order is not affected.
+func numberLabels(tests []*TestLine) {
+	n := 0
+	for _, test := range tests {
+		if test.Label == "" {
+			continue
+		}
+		n++
+		// Branch target is the only operand,
+		// so the label is always at the end.
+		label := fmt.Sprintf("%s_%d", test.Label, n)
+		relabel := func(s string) string {
+			return strings.TrimSuffix(s, test.Label) + label
+		}
+		test.Asm = relabel(test.Asm)
+		test.Intel = relabel(test.Intel)
+		test.GNU = relabel(test.GNU)
+		test.Objdump = relabel(test.Objdump)
+		test.Label = label
+	}
+}
+
+// GroupByFilename groups tests by their output file name.
+// Tests order is preserved inside every group.
+func GroupByFilename(tests []*TestLine) map[string][]*TestLine {
+	testsByFilename := map[string][]*TestLine{}
+	for _, test := range tests {
+		testsByFilename[test.Filename] = append(testsByFilename[test.Filename], test)
+	}
+	return testsByFilename
+}
+
+func filterInsts(insts []*x86csv.Inst, mode MachineMode) []*x86csv.Inst {
+	var filtered []*x86csv.Inst
+
+	skipByGoOpcode := map[string]bool{
+		"VPEXTRW": true,
+		"VMOVQ":   true,
+		"VMOVHPD": true,
+		"VMOVLPD": true,
+	}
+
+	for _, inst := range insts {
+		valid := inst.Mode64
+		if mode == Mode32 {
+			valid = inst.Mode32
+		}
+		switch {
+		case valid != "V":
+			continue // Not valid in the requested mode
+		case strings.Contains(inst.IntelOpcode(), "NOP"):
+			continue // Skip all kinds of NO-OPs
+		case !strings.Contains(inst.CPUID, "AVX512"):
+			continue // Not an AVX-512 form/instruction
+		case skipByGoOpcode[inst.GoOpcode()]:
+			continue // Explicitly skipped
+		}
+
+		filtered = append(filtered, inst)
+	}
+
+	return filtered
+}
+
+// filterBranchInsts returns rel8 and rel32 forms of the branch
+// instructions that are valid in the given mode.
+// Pseudo-ops, like JNAE (alias for JB), are skipped.
+func filterBranchInsts(insts []*x86csv.Inst, mode MachineMode) []*x86csv.Inst {
+	var filtered []*x86csv.Inst
+	for _, inst := range insts {
+		valid := inst.Mode64
+		if mode == Mode32 {
+			valid = inst.Mode32
+		}
+		switch {
+		case valid != "V":
+			continue // Not valid in the requested mode
+		case !isBranchInst(inst):
+			continue // Not a rel8/rel32 branch form
+		case instHasTag(inst, "pseudo"):
+			continue // Covered by the canonical opcode
+		}
+		filtered = append(filtered, inst)
+	}
+	return filtered
+}
+
+// generator holds the state of a single Generate call.
+type generator struct {
+	cfg     *Config
+	args    ArgStrategy
+	encoder Encoder
+
+	testLineByAsm map[string]*TestLine
+}
+
+// testJob describes a single test line.
+//
+// Jobs are collected sequentially, encoded in batches (possibly concurrently)
+// by encodeBatch and then added to the output in the collection order.
+type testJob struct {
+	inst    *x86csv.Inst
+	argList []Arg
+	bcst    bool // Whether embedded broadcast form is requested
+	asm     string
+
+	// Fields below are set by encodeJobs.
+
+	requests  []encodeRequest
+	encodings []*Encoding
+	failures  []*Failure
+	debug     []string
+	err       error
+}
+
+func newTestJob(inst *x86csv.Inst, argList []Arg, bcst bool) *testJob {
+	suffix := ""
+	if bcst {
+		suffix = ".BCST"
+	}
+	return &testJob{
+		inst:    inst,
+		argList: argList,
+		bcst:    bcst,
+		asm:     goAsmStringWithSuffix(inst, argList, suffix),
+	}
+}
+
+func (job *testJob) debugf(format string, args ...interface{}) {
+	job.debug = append(job.debug, fmt.Sprintf(format, args...))
+}
+
+func (job *testJob) addFailure(rexw, vl x86encode.InstParam, reason string) {
+	job.debugf("%q <%s,%s>: %s", job.asm, rexw, vl, reason)
+	job.failures = append(job.failures, &Failure{
+		Opcode: job.inst.IntelOpcode(),
+		Reason: reason,
+		Test:   fmt.Sprintf("%s <%s,%s>", job.asm, rexw, vl),
+	})
+}
+
+// instJobs returns test jobs for all inst forms.
+func (g *generator) instJobs(inst *x86csv.Inst) ([]*testJob, error) {
+	var argLists [][]Arg
+	for _, arg := range inst.IntelArgs() {
+		list, err := g.args.InstArgs(inst, arg)
+		if errors.Is(err, errNoModeArgs) {
+			g.cfg.addFailure(&Failure{
+				Opcode: inst.IntelOpcode(),
+				Reason: "skipped: " + err.Error(),
+				Test:   inst.Intel,
+			})
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		argLists = append(argLists, list)
+	}
+	argLists = argsCartesianProd(argLists)
+
+	jobs := make([]*testJob, 0, len(argLists))
+	for _, argList := range argLists {
+		if gatherIndexConflict(inst, argList) {
+			g.cfg.debugf("%s: skip args with the same index and destination", inst.Intel)
+			continue
+		}
+		jobs = append(jobs, newTestJob(inst, argList, false))
+	}
+
+	return append(jobs, disp8TestJobs(inst, argLists)...), nil
+}
+
+// disp8TestJobs returns jobs that cover EVEX compressed displacement (disp8*N).
+//
+// Memory operand of the first suitable args list is re-used
+// with displacements that are picked around inst N boundaries.
+// Both full-vector and broadcast (if supported) forms are generated.
+func disp8TestJobs(inst *x86csv.Inst, argLists [][]Arg) []*testJob {
+	if !evexEncoded(inst) {
+		return nil
+	}
+
+	memIndex := -1
+	var template []Arg
+	for _, argList := range argLists {
+		for i, arg := range argList {
+			mem, ok := arg.Data.(*x86encode.MemArgument)
+			if ok && !isVectorReg(mem.Index) {
+				memIndex = i
+				break
+			}
+		}
+		if memIndex != -1 {
+			template = argList
+			break
+		}
+	}
+	if template == nil {
+		return nil // No suitable memory operand
+	}
+
+	var jobs []*testJob
+	addJobs := func(n int, width uint, bcst bool) {
+		for _, disp := range disp8TestDisplacements(n) {
+			mem := *template[memIndex].Data.(*x86encode.MemArgument)
+			mem.Disp = disp
+			mem.Width = width
+
+			argList := make([]Arg, len(template))
+			copy(argList, template)
+			argList[memIndex] = Arg{
+				GoSyntax: memoryExpression(&mem),
+				Data:     &mem,
+			}
+			jobs = append(jobs, newTestJob(inst, argList, bcst))
+		}
+	}
+
+	mem := template[memIndex].Data.(*x86encode.MemArgument)
+	if n := instDispScale(inst, false); n != 0 {
+		addJobs(n, mem.Width, false)
+	}
+	if n := instDispScale(inst, true); n != 0 {
+		addJobs(n, uint(n*8), true)
+	}
+	return jobs
+}
+
+// encodeBatchSize is a minimal number of encoder requests
+// that are passed to the encoder at once (see encodeJobs).
+const encodeBatchSize = 512
+
+// encodeJobs encodes every job using cfg.Jobs goroutines.
+//
+// Jobs are grouped into batches of at least encodeBatchSize requests,
+// so encoders that implement x86encode.BatchDescriber or
+// x86encode.BatchEncoder are called once per batch, not once per job.
+func (g *generator) encodeJobs(jobs []*testJob) {
+	var batches [][]*testJob
+	start, size := 0, 0
+	for i, job := range jobs {
+		job.requests = jobRequests(job)
+		size += len(job.requests)
+		if size >= encodeBatchSize || i == len(jobs)-1 {
+			batches = append(batches, jobs[start:i+1])
+			start, size = i+1, 0
+		}
+	}
+
+	if g.cfg.Jobs < 2 {
+		for _, batch := range batches {
+			g.encodeBatch(batch)
+		}
+		return
+	}
+
+	queue := make(chan []*testJob)
+	var wg sync.WaitGroup
+	wg.Add(g.cfg.Jobs)
+	for i := 0; i < g.cfg.Jobs; i++ {
+		go func() {
+			defer wg.Done()
+			for batch := range queue {
+				g.encodeBatch(batch)
+			}
+		}()
+	}
+	for _, batch := range batches {
+		queue <- batch
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// encodeRequest is a single encoding of the test job instruction.
+type encodeRequest struct {
+	rexw x86encode.InstParam
+	vl   x86encode.InstParam
+	inst *x86encode.Inst
+}
+
+// jobRequests returns job instruction encoding requests
+// for all applicable params.
+func jobRequests(job *testJob) []encodeRequest {
+	var requests []encodeRequest
+	for _, rexw := range instREXW(job.inst) {
+		for _, vl := range instVL(job.inst) {
+			params := []x86encode.InstParam{rexw, vl}
+			if job.bcst {
+				params = append(params, x86encode.ParamBroadcast)
+			}
+			requests = append(requests, encodeRequest{
+				rexw: rexw,
+				vl:   vl,
+				inst: encoderInst(job.inst, job.argList, params),
+			})
+		}
+	}
+	return requests
+}
+
+// encodeBatch encodes requests of all batch jobs at once
+// and passes the results to encodeJob.
+//
+// encodeBatch only modifies batch jobs, so it can be called concurrently.
+func (g *generator) encodeBatch(batch []*testJob) {
+	var insts []*x86encode.Inst
+	for _, job := range batch {
+		for _, req := range job.requests {
+			insts = append(insts, req.inst)
+		}
+	}
+	encs, errs := g.encodeDescribe(insts)
+	for _, job := range batch {
+		n := len(job.requests)
+		g.encodeJob(job, encs[:n], errs[:n])
+		encs, errs = encs[n:], errs[n:]
+	}
+}
+
+// encodeJob records results of job requests. For every request,
+// either encs[i] or errs[i] is set.
+//
+// Encoder failures that are caused by invalid instruction forms are recorded
+// as job failures. Errors that indicate input data mistakes are stored in job.err.
+func (g *generator) encodeJob(job *testJob, encs []*x86encode.Encoding, errs []error) {
+	for i, req := range job.requests {
+		rexw, vl := req.rexw, req.vl
+		err := errs[i]
+		if err != nil {
+			if isDataError(err) {
+				job.err = fmt.Errorf("%q: %v", job.asm, err)
+				return
+			}
+			job.addFailure(rexw, vl, failureReason(err))
+			continue
+		}
+		enc := encs[i]
+		if enc.Hex == "" {
+			job.addFailure(rexw, vl, "empty encoding string")
+			continue
+		}
+		if !strings.HasPrefix(enc.Hex, "62") && evexEncoded(job.inst) {
+			job.debugf("%q <%s,%s>: skip non-evex (enc=%q)\n",
+				job.asm, rexw, vl, enc.Hex)
+			continue
+		}
+		job.encodings = append(job.encodings, &Encoding{
+			Hex:   enc.Hex,
+			Iform: enc.Iform,
+			VL:    vlBits(vl),
+			W:     rexwBit(rexw),
+		})
+	}
+}
+
+// addTestLine reports job failures and records its
+// encodings as a single test line.
+//
+// Jobs should be added in the same order as they were collected,
+// so duplicates are resolved in the same way for any cfg.Jobs value.
+func (g *generator) addTestLine(job *testJob) error {
+	for _, msg := range job.debug {
+		g.cfg.debugf("%s", msg)
+	}
+	for _, f := range job.failures {
+		g.cfg.addFailure(f)
+	}
+	if job.err != nil {
+		return job.err
+	}
+
+	inst, argList, bcst, asm := job.inst, job.argList, job.bcst, job.asm
+
+	if len(job.encodings) == 0 {
+		g.cfg.debugf("%q: empty test set", asm)
+		return nil
+	}
+
+	test := g.testLineByAsm[asm]
+	if test != nil {
+		g.cfg.debugf("%q: skip duplicate (%s)", asm, test.Enc)
+		return nil
+	}
+
+	hexEncodings := make([]string, len(job.encodings))
+	for i, enc := range job.encodings {
+		hexEncodings[i] = enc.Hex
+	}
+
+	filename := "branch"
+	if !isBranchInst(inst) {
+		var err error
+		filename, err = cpuidFilename(inst.CPUID)
+		if err != nil {
+			return fmt.Errorf("%q: %v", asm, err)
+		}
+	}
+
+	g.testLineByAsm[asm] = &TestLine{
+		Asm:   asm,
+		Enc:   strings.Join(hexEncodings, " or "),
+		CPUID: normalizeCPUID(inst.CPUID),
+
+		Filename: filename,
+
+		Intel:     intelAsmString(inst, argList, bcst),
+		GNU:       gnuAsmString(inst, argList, bcst, gnuStyleAs),
+		Objdump:   gnuAsmString(inst, argList, bcst, gnuStyleObjdump),
+		Encodings: job.encodings,
+		Inst:      inst,
+		Label:     relLabel(argList),
+	}
+
+	return nil
+}
+
+// encoderInst returns encoder instruction for inst with given args and params.
+func encoderInst(inst *x86csv.Inst, argList []Arg, params []x86encode.InstParam) *x86encode.Inst {
+	bcst := false
+	for _, param := range params {
+		if param == x86encode.ParamBroadcast {
+			bcst = true
+		}
+	}
+
+	switch inst.DataSize {
+	case "8":
+		params = append(params, x86encode.ParamEOSZ8)
+	case "16":
+		params = append(params, x86encode.ParamEOSZ16)
+	case "32":
+		params = append(params, x86encode.ParamEOSZ32)
+	case "64":
+		params = append(params, x86encode.ParamEOSZ64)
+	default:
+		if instHasTag(inst, "default64") {
+			// Near branches use 64-bit operand size in 64-bit mode.
+			params = append(params, x86encode.ParamEOSZ64)
+		}
+	}
+
+	args := make([]x86encode.Argument, len(argList))
+	for i := range argList {
+		args[i] = argList[i].Data
+		if mem, ok := args[i].(*x86encode.MemArgument); ok {
+			// For AVX512 special handling of displacement is required.
+			// Copy of mem is required as it's shared among several args
+			// and we're about to modify it.
+			copied := *mem
+			copied.DispWidth = dispWidth(copied.Disp, instDispScale(inst, bcst))
+			args[i] = &copied
+		}
+	}
+
+	return &x86encode.Inst{
+		Opcode: inst.IntelOpcode(),
+		Params: params,
+		Args:   args,
+	}
+}
+
+// encodeDescribe encodes and describes insts.
+// Results are index-aligned with insts: for every i,
+// either encs[i] or errs[i] is set.
+//
+// Empty codes are not described: they're reported as encodings with empty Hex.
+func (g *generator) encodeDescribe(insts []*x86encode.Inst) ([]*x86encode.Encoding, []error) {
+	if b, ok := g.encoder.(x86encode.BatchDescriber); ok {
+		return b.EncodeDescribeBatch(insts)
+	}
+	codes, errs := g.encodeInsts(insts)
+	encs := make([]*x86encode.Encoding, len(insts))
+	for i, code := range codes {
+		switch {
+		case errs[i] != nil:
+			// Encoding failed.
+		case len(code) == 0:
+			encs[i] = &x86encode.Encoding{}
+		default:
+			encs[i], errs[i] = g.describe(code)
+		}
+	}
+	return encs, errs
+}
+
+// encodeInsts encodes insts with a single EncodeBatch call
+// if encoder implements BatchEncoder.
+func (g *generator) encodeInsts(insts []*x86encode.Inst) ([][]byte, []error) {
+	if b, ok := g.encoder.(x86encode.BatchEncoder); ok {
+		return b.EncodeBatch(insts)
+	}
+	codes := make([][]byte, len(insts))
+	errs := make([]error, len(insts))
+	for i, inst := range insts {
+		codes[i], errs[i] = g.encoder.Encode(inst)
+	}
+	return codes, errs
+}
+
+// describe returns encoding details for the code.
+func (g *generator) describe(code []byte) (*x86encode.Encoding, error) {
+	if d, ok := g.encoder.(x86encode.Describer); ok {
+		return d.Describe(code)
+	}
+	return &x86encode.Encoding{Hex: fmt.Sprintf("%x", code)}, nil
+}
@@ -0,0 +1,839 @@
+package avx512gen
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/quasilyte/avx512test/internal/x86encode"
+	"golang.org/x/arch/x86/x86csv"
+)
+
+var update = flag.Bool("update", false, "update golden files in testdata")
+
+func TestCPUIDFilename(t *testing.T) {
+	tests := []struct {
+		cpuid string
+		want  string
+	}{
+		{"AVX512F", "avx512f"},
+		{"AVX512F+AVX512VL", "avx512f"},
+		{"AVX512_VBMI+AVX512VL", "avx512_vbmi"},
+		{"AVX512BW+AVX512VL", "avx512bw"},
+		{"GFNI+AVX512F", "gfni_avx512f"},
+		{"GFNI+AVX512VL", "gfni_avx512f"},
+		{"VAES+GFNI+AVX512F", "gfni_vaes_avx512f"},
+		{"GFNI+VAES+AVX512VL", "gfni_vaes_avx512f"},
+		{"GFNI+AVX512_VBMI", "avx512_vbmi_gfni"},
+
+		// Overrides are checked before the name is derived.
+		{"VAES+AVX512VL", "aes_avx512f"},
+		{"AVX512_4FMAPS+AVX512_4VNNIW", "avx512_4x"},
+	}
+
+	cpuidFilenameOverrides["VAES+AVX512VL"] = "aes_avx512f"
+	cpuidFilenameOverrides["AVX512_4FMAPS+AVX512_4VNNIW"] = "avx512_4x"
+	defer func() {
+		delete(cpuidFilenameOverrides, "VAES+AVX512VL")
+		delete(cpuidFilenameOverrides, "AVX512_4FMAPS+AVX512_4VNNIW")
+	}()
+
+	for _, test := range tests {
+		have, err := cpuidFilename(test.cpuid)
+		if err != nil {
+			t.Errorf("cpuidFilename(%q): %v", test.cpuid, err)
+			continue
+		}
+		if have != test.want {
+			t.Errorf("cpuidFilename(%q):\nhave: %q\nwant: %q", test.cpuid, have, test.want)
+		}
+	}
+
+	for _, cpuid := range []string{"", "AVX512F+", "avx512f"} {
+		if _, err := cpuidFilename(cpuid); err == nil {
+			t.Errorf("cpuidFilename(%q): expected error", cpuid)
+		}
+	}
+}
+
+func TestGoTableIdent(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"avx512f", "avx512f"},
+		{"aes_avx512f", "aesAvx512f"},
+		{"avx512_4vnniw", "avx5124vnniw"},
+		{"gfni__avx512f", "gfniAvx512f"},
+	}
+	for _, test := range tests {
+		if have := goTableIdent(test.name); have != test.want {
+			t.Errorf("goTableIdent(%q):\nhave: %q\nwant: %q", test.name, have, test.want)
+		}
+	}
+}
+
+func TestArgTable(t *testing.T) {
+	data, err := ioutil.ReadFile("../x86.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	insts, err := (&CSVSource{Data: data}).Insts()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table := NewArgTable()
+	for _, inst := range filterInsts(insts, Mode64) {
+		for _, arg := range inst.IntelArgs() {
+			if _, err := table.InstArgs(inst, arg); err != nil {
+				t.Errorf("%s: %v", inst.Intel, err)
+			}
+		}
+	}
+}
+
+func TestArgTableForMode(t *testing.T) {
+	builtin := NewArgTable()
+	if table := builtin.ForMode(Mode64); table != builtin {
+		t.Errorf("ForMode(Mode64) should return the table as is")
+	}
+
+	table := builtin.ForMode(Mode32)
+	if err := table.Validate(); err != nil {
+		t.Fatalf("32-bit table: %v", err)
+	}
+	for syntax, args := range table.Args {
+		if peeks := table.Peeks[syntax]; peeks > len(args) {
+			t.Errorf("%s: %d peeks for %d args", syntax, peeks, len(args))
+		}
+		for _, arg := range args {
+			switch data := arg.Data.(type) {
+			case *RegArgument:
+				if !mode32Reg(data.Name, regBlockSize(syntax)) {
+					t.Errorf("%s: %s is not available in 32-bit mode", syntax, data.Name)
+				}
+			case *MemArgument:
+				for _, reg := range []string{data.Base, data.Index} {
+					if reg != "" && mode32AddrReg(reg) != reg {
+						t.Errorf("%s: %s: %s is not converted", syntax, arg.GoSyntax, reg)
+					}
+				}
+			}
+		}
+	}
+
+	// r64 has no 32-bit mode operands, so it's dropped instead
+	// of being silently peeked 0 times.
+	if _, ok := table.Args["r64"]; ok {
+		t.Errorf("r64: args are not dropped")
+	}
+	if _, ok := table.Peeks["r64"]; ok {
+		t.Errorf("r64: peeks are not dropped")
+	}
+	inst := &x86csv.Inst{Intel: "VPBROADCASTQ zmm1, {k}{z}, r64"}
+	if _, err := table.InstArgs(inst, "r64"); !errors.Is(err, errNoModeArgs) {
+		t.Errorf("r64: expected no mode args error, got %v", err)
+	}
+	list, err := table.InstArgs(inst, "r/m64")
+	if err != nil {
+		t.Fatalf("r/m64: %v", err)
+	}
+	for _, arg := range list {
+		if _, ok := arg.Data.(*MemArgument); !ok {
+			t.Errorf("r/m64: unexpected %s operand", arg.GoSyntax)
+		}
+	}
+
+	csv := `"VPBROADCASTQ zmm1, {k}{z}, r64","VPBROADCASTQ r64, {k}{z}, zmm1","vpbroadcastq r64, {k}{z}, zmm1","EVEX.512.66.0F38.W1 7C /r","V","V","AVX512F","","w,r,r","",""`
+	var failures []*Failure
+	tests, err := Generate(&Config{
+		Source:    &CSVSource{Data: []byte(csv)},
+		Mode:      Mode32,
+		Encoder:   emptyEncoder{},
+		OnFailure: func(f *Failure) { failures = append(failures, f) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tests) != 0 {
+		t.Errorf("unexpected tests: %d", len(tests))
+	}
+	wantReason := "skipped: r64: no operands are valid in this mode"
+	if len(failures) != 1 || failures[0].Reason != wantReason {
+		t.Errorf("expected a single %q failure, got %+v", wantReason, failures)
+	}
+}
+
+func TestAsmStrings(t *testing.T) {
+	inst := &x86csv.Inst{
+		Intel:    "VADDPD zmm1, {k}{z}, zmmV, zmm2/m512/m64bcst",
+		Go:       "VADDPD zmm2/m512/m64bcst, zmmV, {k}{z}, zmm1",
+		GNU:      "vaddpd zmm2/m512/m64bcst, zmmV, {k}{z}, zmm1",
+		Encoding: "EVEX.NDS.512.66.0F.W1 58 /r",
+		CPUID:    "AVX512F",
+		Tags:     "bscale8,scale64",
+	}
+	args := []Arg{
+		{"Z1", &RegArgument{Name: "ZMM1"}},
+		{"K2", &RegArgument{Name: "K2"}},
+		{"Z2", &RegArgument{Name: "ZMM2"}},
+		{"-17(BP)(SI*4)", &MemArgument{Base: "RBP", Index: "RSI", Scale: 4, Disp: -17, Width: 64}},
+	}
+
+	tests := []struct {
+		name string
+		have string
+		want string
+	}{
+		{"go", goAsmString(inst, args), "VADDPD -17(BP)(SI*4), Z2, K2, Z1"},
+		{"intel", intelAsmString(inst, args, true), "VADDPD ZMM1 {K2}, ZMM2, QWORD PTR [RBP+RSI*4-17]{1to8}"},
+		{"gnu", gnuAsmString(inst, args, true, gnuStyleAs), "vaddpd -17(%rbp,%rsi,4){1to8}, %zmm2, %zmm1{%k2}"},
+		{"objdump", gnuAsmString(inst, args, true, gnuStyleObjdump), "vaddpd -0x11(%rbp,%rsi,4){1to8},%zmm2,%zmm1{%k2}"},
+	}
+
+	for _, test := range tests {
+		if test.have != test.want {
+			t.Errorf("%s:\nhave: %q\nwant: %q", test.name, test.have, test.want)
+		}
+	}
+}
+
+func TestAsmWriter(t *testing.T) {
+	tests := []*TestLine{
+		{Asm: "VADDPD Z2, Z1, Z0", Enc: "62f1f54858c2", CPUID: "AVX512F"},
+	}
+	w := &AsmWriter{Include: "textflag.h", SymbolPrefix: "asmtest_"}
+	files, err := w.WriteTests("avx512f", tests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected 1 file, got %d", len(files))
+	}
+
+	want := strings.Join([]string{
+		"// Code generated by avx512test. DO NOT EDIT.",
+		"",
+		`#include "textflag.h"`,
+		"",
+		"TEXT asmtest_avx512f(SB), NOSPLIT, $0",
+		"\tVADDPD Z2, Z1, Z0                                  // 62f1f54858c2",
+		"\tRET",
+		"",
+	}, "\n")
+	if have := string(files[0].Data); have != want {
+		t.Errorf("output mismatch:\nhave:\n%s\nwant:\n%s", have, want)
+	}
+	if files[0].Name != "avx512f.s" {
+		t.Errorf("file name: have %q, want %q", files[0].Name, "avx512f.s")
+	}
+	if w.Index() != nil {
+		t.Errorf("unexpected index for non-split output")
+	}
+}
+
+func TestLoadArgTable(t *testing.T) {
+	builtin := NewArgTable()
+	if err := builtin.Validate(); err != nil {
+		t.Fatalf("built-in table: %v", err)
+	}
+
+	data, err := builtin.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := LoadArgTable(data)
+	if err != nil {
+		t.Fatalf("load built-in table: %v", err)
+	}
+	if !reflect.DeepEqual(table, builtin) {
+		t.Errorf("built-in table changed after JSON round trip")
+	}
+
+	table, err = LoadArgTable([]byte(`{
+		"args": {"zmm": [{"go": "Z1", "reg": "ZMM1"}], "m512": [{"mem": {"base": "RAX", "disp": 7}}]},
+		"peeks": {"zmm": 1, "m512": 1}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := table.Args["m512"][0].GoSyntax; have != "7(AX)" {
+		t.Errorf("derived mem Go syntax: have %q, want %q", have, "7(AX)")
+	}
+	if have := table.Args["zmm"]; len(have) != 1 {
+		t.Errorf("zmm args are not replaced: have %d args", len(have))
+	}
+	if have := table.Peeks["m512"]; have != 1 {
+		t.Errorf("m512 peeks: have %d, want 1", have)
+	}
+	if !reflect.DeepEqual(table.Args["ymm"], builtin.Args["ymm"]) {
+		t.Errorf("ymm args are not taken from the built-in tables")
+	}
+
+	table, err = LoadArgTable([]byte(`{
+		"args": {"ptr16:32": [{"go": "$0x10:$0x2000", "ptr": {"width": 32, "selector": 16, "offset": 8192}}]},
+		"peeks": {"ptr16:32": 1}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantPtr := &PtrArgument{Width: 32, Selector: 0x10, Offset: 0x2000}
+	if have := table.Args["ptr16:32"][0].Data; !reflect.DeepEqual(have, wantPtr) {
+		t.Errorf("ptr arg: have %+v, want %+v", have, wantPtr)
+	}
+	data, err = table.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, err := LoadArgTable(data); err != nil {
+		t.Errorf("load table with ptr args: %v", err)
+	} else if !reflect.DeepEqual(reloaded, table) {
+		t.Errorf("table with ptr args changed after JSON round trip")
+	}
+
+	badConfigs := []string{
+		`{"unknown": 1}`,
+		`{"args": {"zmm": [{"reg": "ZMM1"}]}, "peeks": {"zmm": 1}}`,
+		`{"args": {"zmm": [{"go": "Z1", "reg": "ZMM1", "imm": {"width": 8}}]}, "peeks": {"zmm": 1}}`,
+		`{"args": {"zmm": []}, "peeks": {"zmm": 1}}`,
+		`{"args": {"imm8": [{"go": "$1", "imm": {"width": 7, "value": 1}}]}, "peeks": {"imm8": 1}}`,
+		`{"args": {"m8": [{"mem": {"base": "R13"}}]}, "peeks": {"m8": 1}}`,
+		`{"args": {"m8": [{"mem": {"base": "RAX", "scale": 3}}]}, "peeks": {"m8": 1}}`,
+		`{"args": {"rel8": [{"go": "L", "rel": {"width": 64, "label": "L"}}]}, "peeks": {"rel8": 1}}`,
+		`{"args": {"rel8": [{"go": "L", "rel": {"width": 8}}]}, "peeks": {"rel8": 1}}`,
+		`{"args": {"ptr16:16": [{"go": "$1:$2", "ptr": {"width": 64}}]}, "peeks": {"ptr16:16": 1}}`,
+		`{"args": {"ptr16:16": [{"go": "$1:$2", "ptr": {"width": 16, "offset": 65536}}]}, "peeks": {"ptr16:16": 1}}`,
+		`{"args": {"new": [{"go": "Z1", "reg": "ZMM1"}]}}`,
+		`{"peeks": {"new": 1}}`,
+		`{"peeks": {"zmm": -1}}`,
+		`{"normalize": {"zmm1": ""}}`,
+		`{"vmemWidths": {"VGATHERDPD": 0}}`,
+	}
+	for _, config := range badConfigs {
+		if _, err := LoadArgTable([]byte(config)); err == nil {
+			t.Errorf("expected error for %s", config)
+		}
+	}
+}
+
+// TestGenerateFixture runs the generator over testdata/x86.csv with
+// recorded encodings, so it does not need XED.
+//
+// testdata/fixture.jsonl is recorded with:
+//
+//	avx512test -x86csv=avx512gen/testdata/x86.csv -record=avx512gen/testdata/fixture.jsonl
+func TestGenerateFixture(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/x86.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open("testdata/fixture.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fixture, err := x86encode.LoadFixture(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var failures []*Failure
+	tests, err := Generate(&Config{
+		Source:    &CSVSource{Data: data},
+		Encoder:   &x86encode.FixtureEncoder{Fixture: fixture},
+		OnFailure: func(f *Failure) { failures = append(failures, f) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range failures {
+		t.Errorf("unexpected failure: %s: %s", f.Test, f.Reason)
+	}
+
+	w := &AsmWriter{Include: "textflag.h", SymbolPrefix: "asmtest_"}
+	files, err := w.WriteTests("avx512f", tests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected 1 file, got %d", len(files))
+	}
+
+	golden := "testdata/avx512f.s"
+	if *update {
+		if err := ioutil.WriteFile(golden, files[0].Data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(files[0].Data, want) {
+		t.Errorf("output mismatch (run with -update to accept):\nhave:\n%s\nwant:\n%s",
+			files[0].Data, want)
+	}
+}
+
+// TestGenerateJobs checks that concurrent encoding does not
+// change the generated tests. Run it with -race to check
+// that the encoder and the recorder are safe for concurrent use.
+func TestGenerateJobs(t *testing.T) {
+	data, err := ioutil.ReadFile("../x86.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := &CSVSource{Data: data}
+	insts, err := source.Insts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder := x86encode.NewGoEncoder(insts, x86encode.Mode64)
+
+	type result struct {
+		tests    []*TestLine
+		failures []*Failure
+		fixture  string
+	}
+	generate := func(jobs int) *result {
+		var r result
+		recorder := &x86encode.RecordingEncoder{Encoder: encoder, Fixture: x86encode.NewFixture(x86encode.Mode64)}
+		tests, err := Generate(&Config{
+			Source:    source,
+			Encoder:   recorder,
+			Jobs:      jobs,
+			OnFailure: func(f *Failure) { r.failures = append(r.failures, f) },
+		})
+		if err != nil {
+			t.Fatalf("jobs=%d: %v", jobs, err)
+		}
+		r.tests = tests
+		var buf bytes.Buffer
+		if _, err := recorder.Fixture.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		r.fixture = buf.String()
+		return &r
+	}
+
+	want := generate(1)
+	if len(want.tests) == 0 {
+		t.Fatal("no tests generated")
+	}
+	for _, jobs := range []int{2, 8} {
+		have := generate(jobs)
+		if !reflect.DeepEqual(have.tests, want.tests) {
+			t.Errorf("jobs=%d: tests mismatch", jobs)
+		}
+		if !reflect.DeepEqual(have.failures, want.failures) {
+			t.Errorf("jobs=%d: failures mismatch", jobs)
+		}
+		if have.fixture != want.fixture {
+			t.Errorf("jobs=%d: recorded fixture mismatch", jobs)
+		}
+	}
+}
+
+type encoderFunc func(inst *x86encode.Inst) ([]byte, error)
+
+func (f encoderFunc) Encode(inst *x86encode.Inst) ([]byte, error) { return f(inst) }
+
+func TestGenerateBranches(t *testing.T) {
+	csv := strings.Join([]string{
+		`"CALL rel32","CALL rel32","call rel32","E8 cd","N.S.","V","","default64","r","Y",""`,
+		`"JMP rel8","JMP rel8","jmp rel8","EB cb","N.S.","V","","default64","r","Y",""`,
+		`"JMP rel32","JMP rel32","jmp rel32","E9 cd","N.S.","V","","default64","r","Y",""`,
+		`"JMP rel32","JMP rel32","jmp rel32","E9 cd","V","N.S.","","operand32","r","Y",""`,
+		`"JMP rel16","JMP rel16","jmp rel16","E9 cw","V","N.S.","","operand16","r","Y",""`,
+		`"JNA rel8","JNA rel8","jna rel8","76 cb","V","V","","pseudo","r","",""`,
+	}, "\n")
+
+	encoder := encoderFunc(func(inst *x86encode.Inst) ([]byte, error) {
+		rel := inst.Args[0].(*x86encode.RelArgument)
+		hasEOSZ64 := false
+		for _, param := range inst.Params {
+			hasEOSZ64 = hasEOSZ64 || param == x86encode.ParamEOSZ64
+		}
+		switch {
+		case rel.Offset != 0:
+			t.Errorf("%s: unexpected offset %d", rel.Label, rel.Offset)
+		case !hasEOSZ64:
+			t.Errorf("%s: EOSZ64 param is not set", rel.Label)
+		}
+		switch {
+		case inst.Opcode == "CALL":
+			return []byte{0xe8, 0, 0, 0, 0}, nil
+		case rel.Width == 8:
+			return []byte{0xeb, 0x00}, nil
+		default:
+			return []byte{0xe9, 0, 0, 0, 0}, nil
+		}
+	})
+
+	generate := func(branches bool) []*TestLine {
+		tests, err := Generate(&Config{
+			Source:   &CSVSource{Data: []byte(csv)},
+			Branches: branches,
+			Encoder:  encoder,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tests
+	}
+
+	if tests := generate(false); len(tests) != 0 {
+		t.Errorf("branch tests are generated without Branches: %d tests", len(tests))
+	}
+
+	tests := generate(true)
+	type result struct{ asm, intel, gnu, objdump, label, enc, filename string }
+	var have []result
+	for _, test := range tests {
+		have = append(have, result{test.Asm, test.Intel, test.GNU, test.Objdump, test.Label, test.Enc, test.Filename})
+	}
+	want := []result{
+		{"CALL rel32_target_1", "CALL rel32_target_1", "call rel32_target_1", "call rel32_target_1", "rel32_target_1", "e800000000", "branch"},
+		{"JMP rel32_target_2", "JMP rel32_target_2", "jmp rel32_target_2", "jmp rel32_target_2", "rel32_target_2", "e900000000", "branch"},
+		{"JMP rel8_target_3", "JMP rel8_target_3", "jmp rel8_target_3", "jmp rel8_target_3", "rel8_target_3", "eb00", "branch"},
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("tests mismatch:\nhave: %+v\nwant: %+v", have, want)
+	}
+	for i, relaxable := range []bool{false, true, false} {
+		if have := tests[i].Relaxable(); have != relaxable {
+			t.Errorf("%s: relaxable: have %v, want %v", tests[i].Asm, have, relaxable)
+		}
+	}
+
+	files, err := (&GoTableWriter{Package: "x86"}).WriteTests("branch", tests)
+	if err != nil {
+		t.Fatalf("gotable: %v", err)
+	}
+	for _, line := range []string{
+		`Go:    "JMP rel32_target_2",`,
+		`{0xe9, 0x00, 0x00, 0x00, 0x00},`,
+		`Go:    "JMP rel8_target_3",`,
+		`{0xeb, 0x00},`,
+	} {
+		if !strings.Contains(string(files[0].Data), line) {
+			t.Errorf("gotable: missing %q in output:\n%s", line, files[0].Data)
+		}
+	}
+	files, err = (&JSONLWriter{}).WriteTests("branch", tests)
+	if err != nil {
+		t.Fatalf("jsonl: %v", err)
+	}
+	if n := strings.Count(string(files[0].Data), `"intel":"JMP rel`); n != 2 {
+		t.Errorf("jsonl: expected 2 JMP records, got %d:\n%s", n, files[0].Data)
+	}
+
+	// Every label is defined right after its branch.
+	// Go assembler can't be told to use rel32 form of JMP.
+	files, err = (&AsmWriter{Include: "textflag.h", SymbolPrefix: "asmtest_"}).WriteTests("branch", tests)
+	if err != nil {
+		t.Fatalf("asm: %v", err)
+	}
+	wantAsm := strings.Join([]string{
+		"// Code generated by avx512test. DO NOT EDIT.",
+		"",
+		`#include "textflag.h"`,
+		"",
+		"TEXT asmtest_branch(SB), NOSPLIT, $0",
+		fmt.Sprintf("\t%-50s // %s", "CALL rel32_target_1", "e800000000"),
+		"rel32_target_1:",
+		fmt.Sprintf("\t//TODO: %-50s // %s", "JMP rel32_target_2", "e900000000"),
+		fmt.Sprintf("\t%-50s // %s", "JMP rel8_target_3", "eb00"),
+		"rel8_target_3:",
+		"\tRET",
+		"",
+	}, "\n")
+	if have := string(files[0].Data); have != wantAsm {
+		t.Errorf("asm output mismatch:\nhave:\n%s\nwant:\n%s", have, wantAsm)
+	}
+
+	files, err = (&GasWriter{}).WriteTests("branch", tests)
+	if err != nil {
+		t.Fatalf("gas: %v", err)
+	}
+	wantSrc := strings.Join([]string{
+		"# Code generated by avx512test. DO NOT EDIT.",
+		"# Check 64bit branch instructions",
+		"",
+		"\t.allow_index_reg",
+		"\t.text",
+		"_start:",
+		"\tcall .Lrel32_target_1",
+		".Lrel32_target_1:",
+		"\t{disp32} jmp .Lrel32_target_2",
+		".Lrel32_target_2:",
+		"\tjmp .Lrel8_target_3",
+		".Lrel8_target_3:",
+		"",
+	}, "\n")
+	if have := string(files[0].Data); have != wantSrc {
+		t.Errorf("gas source mismatch:\nhave:\n%s\nwant:\n%s", have, wantSrc)
+	}
+	// The expected bytes check the branch form and
+	// that the target is the next instruction.
+	// Sample objdump lines come from binutils versions
+	// with and without "q" suffix for 64-bit branches.
+	dump := string(files[1].Data)
+	for _, c := range []struct{ pattern, objdump string }{
+		{
+			"[ \t]*[a-f0-9]+:[ \t]*e8 00 00 00 00[ \t]*callq?[ \t]+[a-f0-9]+ <_start\\+0x[a-f0-9]+>",
+			"   0:\te8 00 00 00 00       \tcall   5 <_start+0x5>",
+		},
+		{
+			"[ \t]*[a-f0-9]+:[ \t]*e9 00 00 00 00[ \t]*jmpq?[ \t]+[a-f0-9]+ <_start\\+0x[a-f0-9]+>",
+			"   5:\te9 00 00 00 00       \tjmpq   a <_start+0xa>",
+		},
+		{
+			"[ \t]*[a-f0-9]+:[ \t]*eb 00[ \t]*jmpq?[ \t]+[a-f0-9]+ <_start\\+0x[a-f0-9]+>",
+			"   a:\teb 00                \tjmp    c <_start+0xc>",
+		},
+	} {
+		if !strings.Contains(dump, c.pattern+"\n") {
+			t.Errorf("gas: missing %q in .d file:\n%s", c.pattern, dump)
+		}
+		if !regexp.MustCompile("^" + c.pattern + "$").MatchString(c.objdump) {
+			t.Errorf("gas: %q doesn't match %q", c.pattern, c.objdump)
+		}
+	}
+
+	for _, syntax := range []string{"att", "intel"} {
+		files, err = (&LLVMWriter{Syntax: syntax}).WriteTests("branch", tests)
+		if err != nil {
+			t.Fatalf("llvm %s: %v", syntax, err)
+		}
+		suffix := ""
+		if syntax == "att" {
+			suffix = "{{q?}}"
+		}
+		for _, lines := range [][]string{
+			{
+				"// CHECK: call" + suffix + " rel32_target_1",
+				"// CHECK: encoding: [0xe8,A,A,A,A]",
+				"          call rel32_target_1",
+				"rel32_target_1:",
+			},
+			{
+				"// CHECK: jmp" + suffix + " rel32_target_2",
+				"// CHECK: encoding: [0xe9,A,A,A,A]",
+				"          {disp32} jmp rel32_target_2",
+				"rel32_target_2:",
+			},
+			{
+				"// CHECK: jmp" + suffix + " rel8_target_3",
+				"// CHECK: encoding: [0xeb,A]",
+				"          jmp rel8_target_3",
+				"rel8_target_3:",
+			},
+		} {
+			block := strings.Join(lines, "\n") + "\n"
+			if !strings.Contains(string(files[0].Data), block) {
+				t.Errorf("llvm %s: missing block in output:\n%s\noutput:\n%s", syntax, block, files[0].Data)
+			}
+		}
+		if strings.Contains(string(files[0].Data), "-mattr=+,") {
+			t.Errorf("llvm %s: empty feature in RUN line:\n%s", syntax, files[0].Data)
+		}
+	}
+}
+
+func TestProvenance(t *testing.T) {
+	info := &GeneratorInfo{
+		Encoder:       "go",
+		X86CSVVersion: "v0.2x",
+		X86CSVHash:    "abc",
+		Flags:         []string{"-encoder=go"},
+	}
+	want := []string{
+		"encoder: go",
+		"x86.csv: v0.2x",
+		"x86.csv sha256: abc",
+		"flags: -encoder=go",
+	}
+	if have := info.Provenance(); !reflect.DeepEqual(have, want) {
+		t.Errorf("non-XED provenance:\nhave: %q\nwant: %q", have, want)
+	}
+
+	info.Encoder = "xed"
+	info.XEDVersion = "v12.0"
+	want = append([]string{"encoder: xed", "xed: v12.0"}, want[1:]...)
+	if have := info.Provenance(); !reflect.DeepEqual(have, want) {
+		t.Errorf("XED provenance:\nhave: %q\nwant: %q", have, want)
+	}
+
+	// Every written file should have a header that can be parsed back.
+	wantHeader := map[string]string{
+		"encoder":        "xed",
+		"xed":            "v12.0",
+		"x86.csv":        "v0.2x",
+		"x86.csv sha256": "abc",
+		"flags":          "-encoder=go",
+	}
+	tests := []*TestLine{{
+		Asm:       "VADDPD Z2, Z1, Z0",
+		Enc:       "62f1f54858c2",
+		CPUID:     "AVX512F",
+		Encodings: []*Encoding{{Hex: "62f1f54858c2"}},
+		Inst:      &x86csv.Inst{CPUID: "AVX512F"},
+	}}
+	writers := map[string]Writer{
+		"asm":     &AsmWriter{Generator: info},
+		"jsonl":   &JSONLWriter{Generator: info},
+		"gas":     &GasWriter{Generator: info},
+		"gotable": &GoTableWriter{Package: "x86", Generator: info},
+	}
+	for name, w := range writers {
+		files, err := w.WriteTests("avx512f", tests)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, f := range files {
+			if !f.HasProvenance() {
+				t.Errorf("%s: %s: no provenance header", name, f.Name)
+				continue
+			}
+			if have := f.ParseProvenance(f.Data); !reflect.DeepEqual(have, wantHeader) {
+				t.Errorf("%s: %s: header mismatch:\nhave: %q\nwant: %q", name, f.Name, have, wantHeader)
+			}
+		}
+	}
+
+	files, err := (&JSONLWriter{Generator: info}).WriteTests("avx512f", tests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(files[0].Data), `{"provenance":["encoder: xed","xed: v12.0",`) {
+		t.Errorf("jsonl: unexpected leading record:\n%s", files[0].Data)
+	}
+	// Old files without the header record should not break parsing.
+	if have := files[0].ParseProvenance([]byte(`{"go":"VADDPD Z2, Z1, Z0"}`)); len(have) != 0 {
+		t.Errorf("jsonl: unexpected header in a file without it: %q", have)
+	}
+
+	files, err = (&GasWriter{Generator: info}).WriteTests("avx512f", tests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Header lines should not look like "#key: value" testsuite directives.
+	for _, line := range strings.Split(string(files[1].Data), "\n") {
+		if strings.HasPrefix(line, "## ") && gasDirectiveRE.MatchString(line) {
+			t.Errorf("gas: %s: header line is a directive: %q", files[1].Name, line)
+		}
+	}
+}
+
+// gasDirectiveRE matches run_dump_test option lines.
+var gasDirectiveRE = regexp.MustCompile(`^#[ \t]*[a-zA-Z0-9_]*[ \t]*:`)
+
+// emptyEncoder returns empty code for every instruction and
+// fails to describe it, like XEDEncoder does.
+type emptyEncoder struct{}
+
+func (emptyEncoder) Encode(inst *x86encode.Inst) ([]byte, error) { return nil, nil }
+
+func (emptyEncoder) Describe(code []byte) (*x86encode.Encoding, error) {
+	return nil, errors.New("decode: empty input")
+}
+
+func TestGenerateEmptyEncoding(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/x86.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var failures []*Failure
+	tests, err := Generate(&Config{
+		Source:    &CSVSource{Data: data},
+		Encoder:   emptyEncoder{},
+		OnFailure: func(f *Failure) { failures = append(failures, f) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tests) != 0 {
+		t.Errorf("unexpected tests: %d", len(tests))
+	}
+	if len(failures) == 0 {
+		t.Fatal("no failures reported")
+	}
+	for _, f := range failures {
+		if f.Reason != "empty encoding string" {
+			t.Errorf("%s: unexpected failure reason: %s", f.Test, f.Reason)
+		}
+	}
+}
+
+// batchDescriber implements x86encode.BatchDescriber on top of
+// a plain encoder and counts EncodeDescribeBatch calls.
+type batchDescriber struct {
+	x86encode.Encoder
+	calls int
+}
+
+func (enc *batchDescriber) EncodeDescribeBatch(insts []*x86encode.Inst) ([]*x86encode.Encoding, []error) {
+	enc.calls++
+	encs := make([]*x86encode.Encoding, len(insts))
+	errs := make([]error, len(insts))
+	for i, inst := range insts {
+		code, err := enc.Encode(inst)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		encs[i] = &x86encode.Encoding{Hex: fmt.Sprintf("%x", code), Iform: "IFORM"}
+	}
+	return encs, errs
+}
+
+func TestGenerateBatchDescriber(t *testing.T) {
+	data, err := ioutil.ReadFile("../x86.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := &CSVSource{Data: data}
+	insts, err := source.Insts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder := x86encode.NewGoEncoder(insts, x86encode.Mode64)
+
+	want, err := Generate(&Config{Source: source, Encoder: encoder})
+	if err != nil {
+		t.Fatal(err)
+	}
+	batcher := &batchDescriber{Encoder: encoder}
+	have, err := Generate(&Config{Source: source, Encoder: batcher})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(have) != len(want) {
+		t.Fatalf("tests count mismatch: have %d, want %d", len(have), len(want))
+	}
+	for i := range have {
+		if have[i].Asm != want[i].Asm || have[i].Enc != want[i].Enc {
+			t.Errorf("test mismatch:\nhave: %s %s\nwant: %s %s",
+				have[i].Asm, have[i].Enc, want[i].Asm, want[i].Enc)
+		}
+		for _, enc := range have[i].Encodings {
+			if enc.Iform != "IFORM" {
+				t.Errorf("%s: iform is not taken from the batch: %q", have[i].Asm, enc.Iform)
+			}
+		}
+	}
+	// Requests of many test lines should share a batch.
+	if maxCalls := len(want)/16 + 1; batcher.calls > maxCalls {
+		t.Errorf("too many batches: %d for %d tests", batcher.calls, len(want))
+	}
+}
@@ -0,0 +1,336 @@
+package avx512gen
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// argTableJSON is a JSON representation of ArgTable.
+//
+// Every section is optional. Entries are merged into the
+// built-in tables, replacing the entries with the same key.
+type argTableJSON struct {
+	Args       map[string][]*argJSON `json:"args,omitempty"`
+	Peeks      map[string]int        `json:"peeks,omitempty"`
+	Normalize  map[string]string     `json:"normalize,omitempty"`
+	VMemWidths map[string]uint16     `json:"vmemWidths,omitempty"`
+}
+
+// argJSON is a JSON representation of Arg.
+// Exactly one of Reg, Imm, Mem, Rel and Ptr should be set.
+//
+// Go syntax can be omitted for memory operands.
+type argJSON struct {
+	Go  string   `json:"go,omitempty"`
+	Reg string   `json:"reg,omitempty"`
+	Imm *immJSON `json:"imm,omitempty"`
+	Mem *memJSON `json:"mem,omitempty"`
+	Rel *relJSON `json:"rel,omitempty"`
+	Ptr *ptrJSON `json:"ptr,omitempty"`
+}
+
+// immJSON is a JSON representation of ImmArgument.
+type immJSON struct {
+	Width    uint   `json:"width"`
+	Value    uint64 `json:"value"`
+	Unsigned bool   `json:"unsigned,omitempty"`
+}
+
+// memJSON is a JSON representation of MemArgument.
+type memJSON struct {
+	Base  string `json:"base"`
+	Index string `json:"index,omitempty"`
+	Scale int    `json:"scale,omitempty"`
+	Disp  int32  `json:"disp,omitempty"`
+	Width uint   `json:"width,omitempty"`
+}
+
+// relJSON is a JSON representation of RelArgument.
+type relJSON struct {
+	Width  uint   `json:"width"`
+	Offset int32  `json:"offset,omitempty"`
+	Label  string `json:"label"`
+}
+
+// ptrJSON is a JSON representation of PtrArgument.
+type ptrJSON struct {
+	Width    uint   `json:"width"`
+	Selector uint16 `json:"selector"`
+	Offset   uint32 `json:"offset"`
+}
+
+// LoadArgTable decodes ArgTable from JSON config data.
+//
+// Config entries are merged into NewArgTable() tables, so only
+// the differences need to be specified.
+// The resulting table is validated.
+func LoadArgTable(data []byte) (*ArgTable, error) {
+	var config argTableJSON
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&config); err != nil {
+		return nil, err
+	}
+
+	builtin := NewArgTable()
+	table := &ArgTable{
+		Args:       map[string][]Arg{},
+		Peeks:      map[string]int{},
+		Normalize:  map[string]string{},
+		VMemWidths: map[string]uint16{},
+	}
+	for syntax, args := range builtin.Args {
+		table.Args[syntax] = args
+	}
+	for syntax, args := range config.Args {
+		list := make([]Arg, len(args))
+		for i, arg := range args {
+			parsed, err := arg.toArg()
+			if err != nil {
+				return nil, fmt.Errorf("args[%q][%d]: %v", syntax, i, err)
+			}
+			list[i] = parsed
+		}
+		table.Args[syntax] = list
+	}
+	for _, m := range []map[string]int{builtin.Peeks, config.Peeks} {
+		for syntax, npeeks := range m {
+			table.Peeks[syntax] = npeeks
+		}
+	}
+	for _, m := range []map[string]string{builtin.Normalize, config.Normalize} {
+		for from, to := range m {
+			table.Normalize[from] = to
+		}
+	}
+	for _, m := range []map[string]uint16{builtin.VMemWidths, config.VMemWidths} {
+		for opcode, width := range m {
+			table.VMemWidths[opcode] = width
+		}
+	}
+
+	if err := table.Validate(); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// MarshalJSON encodes table in a format that is accepted by LoadArgTable.
+func (table *ArgTable) MarshalJSON() ([]byte, error) {
+	config := argTableJSON{
+		Args:       map[string][]*argJSON{},
+		Peeks:      table.Peeks,
+		Normalize:  table.Normalize,
+		VMemWidths: table.VMemWidths,
+	}
+	for syntax, args := range table.Args {
+		list := make([]*argJSON, len(args))
+		for i, arg := range args {
+			list[i] = &argJSON{Go: arg.GoSyntax}
+			switch data := arg.Data.(type) {
+			case *RegArgument:
+				list[i].Reg = data.Name
+			case *ImmArgument:
+				list[i].Imm = &immJSON{
+					Width:    data.Width,
+					Value:    data.Value,
+					Unsigned: data.Unsigned,
+				}
+			case *MemArgument:
+				list[i].Mem = &memJSON{
+					Base:  data.Base,
+					Index: data.Index,
+					Scale: data.Scale,
+					Disp:  data.Disp,
+					Width: data.Width,
+				}
+			case *RelArgument:
+				list[i].Rel = &relJSON{
+					Width:  data.Width,
+					Offset: data.Offset,
+					Label:  data.Label,
+				}
+			case *PtrArgument:
+				list[i].Ptr = &ptrJSON{
+					Width:    data.Width,
+					Selector: data.Selector,
+					Offset:   data.Offset,
+				}
+			default:
+				return nil, fmt.Errorf("args[%q][%d]: unexpected %T operand", syntax, i, data)
+			}
+		}
+		config.Args[syntax] = list
+	}
+	return json.MarshalIndent(config, "", "  ")
+}
+
+// Validate checks table consistency.
+func (table *ArgTable) Validate() error {
+	syntaxes := make([]string, 0, len(table.Args))
+	for syntax := range table.Args {
+		syntaxes = append(syntaxes, syntax)
+	}
+	sort.Strings(syntaxes)
+
+	for _, syntax := range syntaxes {
+		args := table.Args[syntax]
+		npeeks, ok := table.Peeks[syntax]
+		switch {
+		case !ok:
+			return fmt.Errorf("args[%q]: undefined npeeks", syntax)
+		case npeeks < 0:
+			return fmt.Errorf("peeks[%q]: negative value", syntax)
+		case npeeks != 0 && len(args) == 0:
+			return fmt.Errorf("args[%q]: empty list", syntax)
+		}
+		for i, arg := range args {
+			if err := validateArg(arg); err != nil {
+				return fmt.Errorf("args[%q][%d]: %v", syntax, i, err)
+			}
+		}
+	}
+
+	for syntax := range table.Peeks {
+		if _, ok := table.Args[syntax]; !ok {
+			return fmt.Errorf("peeks[%q]: no args", syntax)
+		}
+	}
+	for from, to := range table.Normalize {
+		if to == "" {
+			return fmt.Errorf("normalize[%q]: empty value", from)
+		}
+	}
+	for opcode, width := range table.VMemWidths {
+		if width == 0 {
+			return fmt.Errorf("vmemWidths[%q]: zero width", opcode)
+		}
+	}
+
+	return nil
+}
+
+func (arg *argJSON) toArg() (Arg, error) {
+	n := 0
+	var data Argument
+	if arg.Reg != "" {
+		n++
+		data = &RegArgument{Name: arg.Reg}
+	}
+	if arg.Imm != nil {
+		n++
+		data = &ImmArgument{
+			Width:    arg.Imm.Width,
+			Value:    arg.Imm.Value,
+			Unsigned: arg.Imm.Unsigned,
+		}
+	}
+	var mem *MemArgument
+	if arg.Mem != nil {
+		n++
+		mem = &MemArgument{
+			Base:  arg.Mem.Base,
+			Index: arg.Mem.Index,
+			Scale: arg.Mem.Scale,
+			Disp:  arg.Mem.Disp,
+			Width: arg.Mem.Width,
+		}
+		data = mem
+	}
+	if arg.Rel != nil {
+		n++
+		data = &RelArgument{
+			Width:  arg.Rel.Width,
+			Offset: arg.Rel.Offset,
+			Label:  arg.Rel.Label,
+		}
+	}
+	if arg.Ptr != nil {
+		n++
+		data = &PtrArgument{
+			Width:    arg.Ptr.Width,
+			Selector: arg.Ptr.Selector,
+			Offset:   arg.Ptr.Offset,
+		}
+	}
+	if n != 1 {
+		return Arg{}, errors.New("exactly one of reg, imm, mem, rel and ptr should be set")
+	}
+
+	goSyntax := arg.Go
+	if goSyntax == "" && mem != nil {
+		if err := validateMem(mem); err != nil {
+			return Arg{}, err
+		}
+		goSyntax = memoryExpression(mem)
+	}
+	return Arg{GoSyntax: goSyntax, Data: data}, nil
+}
+
+func validateArg(arg Arg) error {
+	if arg.GoSyntax == "" {
+		return errors.New("empty Go syntax")
+	}
+	switch data := arg.Data.(type) {
+	case *RegArgument:
+		if data.Name == "" {
+			return errors.New("empty register name")
+		}
+	case *ImmArgument:
+		switch data.Width {
+		case 8, 16, 32, 64:
+			// OK.
+		default:
+			return fmt.Errorf("bad imm width %d", data.Width)
+		}
+	case *MemArgument:
+		return validateMem(data)
+	case *RelArgument:
+		switch data.Width {
+		case 8, 16, 32:
+			// OK.
+		default:
+			return fmt.Errorf("bad rel width %d", data.Width)
+		}
+		if data.Label == "" {
+			return errors.New("empty rel label")
+		}
+	case *PtrArgument:
+		switch data.Width {
+		case 16, 32:
+			// OK.
+		default:
+			return fmt.Errorf("bad ptr width %d", data.Width)
+		}
+		if data.Width == 16 && data.Offset > 0xffff {
+			return fmt.Errorf("ptr offset %#x overflows 16 bits", data.Offset)
+		}
+	default:
+		return fmt.Errorf("unexpected %T operand", data)
+	}
+	return nil
+}
+
+func validateMem(mem *MemArgument) error {
+	if mem.Base == "" {
+		return errors.New("empty mem base")
+	}
+	// Go syntax of memory operands is re-generated for disp8 tests,
+	// so all registers should have Go names.
+	if intelRegToGoRegMap[mem.Base] == "" {
+		return fmt.Errorf("unsupported mem base %q", mem.Base)
+	}
+	if mem.Index != "" && intelRegToGoRegMap[mem.Index] == "" && !isVectorReg(mem.Index) {
+		return fmt.Errorf("unsupported mem index %q", mem.Index)
+	}
+	switch mem.Scale {
+	case 0, 1, 2, 4, 8:
+		// OK.
+	default:
+		return fmt.Errorf("bad mem scale %d", mem.Scale)
+	}
+	return nil
+}
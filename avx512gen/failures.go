@@ -0,0 +1,31 @@
+package avx512gen
+
+import (
+	"errors"
+
+	"github.com/quasilyte/avx512test/internal/x86encode"
+)
+
+// Failure describes a single instruction form that
+// was not encoded during tests generation.
+type Failure struct {
+	Opcode string // Intel opcode
+	Reason string // Short failure reason, suitable for grouping
+	Test   string // Asm string with encoder params
+}
+
+// failureReason returns encoder error description that is suitable
+// for failures grouping. Unlike err.Error(), it does not include
+// instruction-specific details.
+func failureReason(err error) string {
+	var xedErr *x86encode.ErrXED
+	var badOperand *x86encode.ErrBadOperand
+	switch {
+	case errors.As(err, &xedErr):
+		return "xed: " + xedErr.Name
+	case errors.As(err, &badOperand):
+		return "bad operand: " + badOperand.Err.Error()
+	default:
+		return err.Error()
+	}
+}
@@ -0,0 +1,106 @@
+package avx512gen
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/quasilyte/avx512test/internal/x86encode"
+	"golang.org/x/arch/x86/x86csv"
+)
+
+// gnuSyntaxStyle controls GNU syntax formatting details.
+type gnuSyntaxStyle int
+
+const (
+	// gnuStyleAs is a GNU as input style: decimal numbers, spaces after commas.
+	gnuStyleAs gnuSyntaxStyle = iota
+
+	// gnuStyleObjdump mimics objdump output: hex numbers, no spaces after commas.
+	gnuStyleObjdump
+)
+
+// gnuAsmString returns GNU (AT&T) syntax asm string for inst with given args.
+// Opcode is taken from x86.csv GNU column.
+// If bcst is true, memory operand is formatted as embedded broadcast.
+func gnuAsmString(inst *x86csv.Inst, args []Arg, bcst bool, style gnuSyntaxStyle) string {
+	op := inst.GNUOpcode()
+	if len(args) == 0 {
+		return op
+	}
+
+	csvArgs := inst.IntelArgs()
+
+	// Collect args in reverse, like for Go syntax.
+	var gnuArgs []string
+	mask := ""
+	for i := len(args) - 1; i >= 0; i-- {
+		s := gnuArgString(inst, args[i].Data, bcst, style)
+		if strings.HasPrefix(csvArgs[i], "{k") {
+			// Opmask operands are attached to the next operand.
+			mask = "{" + s + "}"
+			continue
+		}
+		gnuArgs = append(gnuArgs, s+mask)
+		mask = ""
+	}
+
+	sep := ", "
+	if style == gnuStyleObjdump {
+		sep = ","
+	}
+	return op + " " + strings.Join(gnuArgs, sep)
+}
+
+func gnuArgString(inst *x86csv.Inst, arg x86encode.Argument, bcst bool, style gnuSyntaxStyle) string {
+	switch arg := arg.(type) {
+	case *x86encode.RegArgument:
+		return gnuRegister(arg.Name)
+	case *x86encode.ImmArgument:
+		if style == gnuStyleObjdump {
+			return fmt.Sprintf("$0x%x", arg.Value)
+		}
+		return fmt.Sprintf("$%d", arg.Value)
+	case *x86encode.MemArgument:
+		s := gnuMemoryExpression(arg, style)
+		if bcst {
+			vl := vlBits(instVL(inst)[0])
+			s += fmt.Sprintf("{1to%d}", vl/int(arg.Width))
+		}
+		return s
+	case *x86encode.RelArgument:
+		return arg.Label
+	case *x86encode.PtrArgument:
+		return fmt.Sprintf("$%#x,$%#x", arg.Selector, arg.Offset)
+	default:
+		panic(fmt.Sprintf("unexpected arg type: %T", arg))
+	}
+}
+
+func gnuRegister(intelName string) string {
+	return "%" + strings.ToLower(intelName)
+}
+
+// gnuMemoryExpression returns mem formatted in AT&T syntax,
+// like "-17(%rbp,%rsi,4)".
+func gnuMemoryExpression(mem *x86encode.MemArgument, style gnuSyntaxStyle) string {
+	expr := gnuRegister(mem.Base)
+	if mem.Index != "" {
+		scale := 1 // Default
+		if mem.Scale != 0 {
+			scale = mem.Scale
+		}
+		expr += fmt.Sprintf(",%s,%d", gnuRegister(mem.Index), scale)
+	}
+	expr = "(" + expr + ")"
+
+	switch {
+	case mem.Disp == 0:
+		return expr
+	case style == gnuStyleObjdump && mem.Disp < 0:
+		return fmt.Sprintf("-0x%x", -int64(mem.Disp)) + expr
+	case style == gnuStyleObjdump:
+		return fmt.Sprintf("0x%x", mem.Disp) + expr
+	default:
+		return fmt.Sprint(mem.Disp) + expr
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package avx512gen
 
 import (
 	"fmt"
@@ -53,6 +53,10 @@ var intelRegToGoRegMap = map[string]string{
 
 func intelRegToGoReg(intelName string) string {
 	goName := intelRegToGoRegMap[intelName]
+	if goName == "" && isVectorReg(intelName) {
+		// XMM1 => X1, ZMM31 => Z31.
+		goName = intelName[:1] + intelName[len("XMM"):]
+	}
 	if goName == "" {
 		panic(fmt.Sprintf("empty Intel->Go reg mapping for %q", intelName))
 	}
@@ -81,3 +85,39 @@ func memoryExpression(mem *x86encode.MemArgument) string {
 
 	return expr
 }
+
+var intelPtrNames = map[uint]string{
+	8:   "BYTE PTR",
+	16:  "WORD PTR",
+	32:  "DWORD PTR",
+	64:  "QWORD PTR",
+	128: "XMMWORD PTR",
+	256: "YMMWORD PTR",
+	512: "ZMMWORD PTR",
+}
+
+// intelMemoryExpression returns mem formatted in Intel syntax,
+// like "ZMMWORD PTR [RBP+RSI*4-17]".
+func intelMemoryExpression(mem *x86encode.MemArgument) string {
+	expr := mem.Base
+
+	if mem.Index != "" {
+		scale := 1 // Default
+		if mem.Scale != 0 {
+			scale = mem.Scale
+		}
+		expr += fmt.Sprintf("+%s*%d", mem.Index, scale)
+	}
+
+	switch {
+	case mem.Disp > 0:
+		expr += fmt.Sprintf("+%d", mem.Disp)
+	case mem.Disp < 0:
+		expr += fmt.Sprintf("%d", mem.Disp)
+	}
+
+	if ptr := intelPtrNames[mem.Width]; ptr != "" {
+		return ptr + " [" + expr + "]"
+	}
+	return "[" + expr + "]"
+}
@@ -0,0 +1,273 @@
+package avx512gen
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"golang.org/x/arch/x86/x86csv"
+)
+
+// File is a generated output file.
+type File struct {
+	// Name is a file name relative to the output directory.
+	Name string
+
+	// Data is a file contents.
+	Data []byte
+
+	// Comment is a line comment token that is used for the provenance
+	// header, like "//". Empty if file has no provenance comment block.
+	Comment string
+
+	// jsonHeader is true if the provenance header is
+	// the leading JSON record (see JSONLWriter).
+	jsonHeader bool
+}
+
+// Writer renders tests that share the same output file name.
+type Writer interface {
+	// WriteTests returns files for tests.
+	// Name is a CPUID-derived file name without extension (see TestLine.Filename).
+	WriteTests(name string, tests []*TestLine) ([]*File, error)
+}
+
+// AsmTemplate is a default template for AsmWriter.
+const AsmTemplate = `// Code generated by avx512test. DO NOT EDIT.
+{{- range .Generator.Provenance }}
+// {{ . }}
+{{- end }}
+
+#include "{{.Include}}"
+{{ range .Funcs }}
+TEXT {{.Symbol}}(SB), NOSPLIT, $0
+{{ range .Tests }}
+  {{- if or $.Commented .Relaxable }}
+    {{- printf "\t//TODO: %-50s // %s\n" .Asm .Enc }}
+  {{- else }}
+    {{- printf "\t%-50s // %s\n" .Asm .Enc }}
+    {{- with .Label }}{{ printf "%s:\n" . }}{{ end }}
+  {{- end }}
+{{- end }}
+{{- printf "\tRET\n" }}
+{{- end }}`
+
+// ParseAsmTemplate parses AsmWriter template text.
+// Template is executed with AsmTemplateData.
+func ParseAsmTemplate(text string) (*template.Template, error) {
+	return template.New("asmtest").Parse(text)
+}
+
+// AsmTemplateData is passed to the AsmWriter template.
+type AsmTemplateData struct {
+	// Name is an output file name without extension, like "avx512f".
+	Name string
+
+	// CPUID is a normalized CPUID of all Tests, like "AVX512F".
+	CPUID string
+
+	// Tests is a sorted list of test lines.
+	Tests []*TestLine
+
+	// Funcs is a list of TEXT functions that hold Tests.
+	// Unless Split or MaxLines is used, there is only one function.
+	Funcs []*AsmFunc
+
+	// Commented is true if all tests should be put under TODO comment.
+	Commented bool
+
+	// Include is a path to textflag.h file.
+	Include string
+
+	// SymbolPrefix is a TEXT symbol name prefix.
+	SymbolPrefix string
+
+	// Generator describes the generator invocation.
+	Generator *GeneratorInfo
+}
+
+// AsmFunc is a single TEXT function of the asm output.
+type AsmFunc struct {
+	// Symbol is a TEXT symbol name, like "asmtest_avx512f".
+	Symbol string
+
+	// Tests is a list of test lines that form function body.
+	Tests []*TestLine
+}
+
+// AsmWriter writes Go assembler test files.
+//
+// Branch target labels are defined right after the branch.
+// Go assembler always picks the rel8 form for relaxable branches
+// (see TestLine.Relaxable), so they're written as TODO comments.
+type AsmWriter struct {
+	// Template is used to render files.
+	// If nil, AsmTemplate is used.
+	Template *template.Template
+
+	// Include is a path to textflag.h file.
+	Include string
+
+	// SymbolPrefix is a TEXT symbol name prefix, like "asmtest_".
+	SymbolPrefix string
+
+	// Split selects how tests are distributed among TEXT functions:
+	// "mnemonic" (one function per instruction), "vl" (one function
+	// per vector length) or "" (single function).
+	Split string
+
+	// MaxLines is a max number of test lines per TEXT function.
+	// No limit if 0.
+	MaxLines int
+
+	// Commented makes all test lines TODO comments.
+	Commented bool
+
+	// Generator is used to write provenance header. Optional.
+	Generator *GeneratorInfo
+
+	symbols []string // "<file> <symbol>" pairs
+}
+
+// WriteTests implements Writer interface.
+func (w *AsmWriter) WriteTests(name string, tests []*TestLine) ([]*File, error) {
+	tmpl := w.Template
+	if tmpl == nil {
+		var err error
+		tmpl, err = ParseAsmTemplate(AsmTemplate)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tdata := AsmTemplateData{
+		Name:         name,
+		CPUID:        tests[0].CPUID,
+		Tests:        tests,
+		Funcs:        w.splitFuncs(name, tests),
+		Commented:    w.Commented,
+		Include:      w.Include,
+		SymbolPrefix: w.SymbolPrefix,
+		Generator:    w.Generator,
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, tdata); err != nil {
+		return nil, err
+	}
+	for _, fn := range tdata.Funcs {
+		w.symbols = append(w.symbols, name+".s "+fn.Symbol)
+	}
+	return []*File{{Name: name + ".s", Data: buf.Bytes(), Comment: "//"}}, nil
+}
+
+// Index returns a list of all TEXT symbols written so far
+// along with the files that define them.
+// Returns nil if neither Split nor MaxLines is used.
+func (w *AsmWriter) Index() *File {
+	if w.Split == "" && w.MaxLines <= 0 {
+		return nil
+	}
+	sort.Strings(w.symbols)
+	var buf bytes.Buffer
+	for _, line := range w.symbols {
+		buf.WriteString(line + "\n")
+	}
+	return &File{Name: "symbols.txt", Data: buf.Bytes()}
+}
+
+// splitFuncs distributes tests among TEXT functions
+// according to Split and MaxLines.
+func (w *AsmWriter) splitFuncs(name string, tests []*TestLine) []*AsmFunc {
+	symbol := w.SymbolPrefix + name
+
+	var keys []string
+	testsByKey := map[string][]*TestLine{}
+	for _, test := range tests {
+		var key string
+		switch w.Split {
+		case "mnemonic":
+			key = strings.ToLower(strings.Split(test.Inst.GoOpcode(), ".")[0])
+		case "vl":
+			key = strconv.Itoa(test.Encodings[0].VL)
+		}
+		if _, ok := testsByKey[key]; !ok {
+			keys = append(keys, key)
+		}
+		testsByKey[key] = append(testsByKey[key], test)
+	}
+	sort.Strings(keys)
+
+	var funcs []*AsmFunc
+	for _, key := range keys {
+		groupSymbol := symbol
+		if key != "" {
+			groupSymbol += "_" + key
+		}
+		group := testsByKey[key]
+		maxLines := w.MaxLines
+		if maxLines <= 0 || len(group) <= maxLines {
+			funcs = append(funcs, &AsmFunc{Symbol: groupSymbol, Tests: group})
+			continue
+		}
+		for i := 0; len(group) != 0; i++ {
+			n := maxLines
+			if n > len(group) {
+				n = len(group)
+			}
+			funcs = append(funcs, &AsmFunc{
+				Symbol: fmt.Sprintf("%s_%d", groupSymbol, i),
+				Tests:  group[:n],
+			})
+			group = group[n:]
+		}
+	}
+
+	return funcs
+}
+
+// jsonlRecord is a single test line representation for JSONLWriter.
+type jsonlRecord struct {
+	Go        string       `json:"go"`
+	Intel     string       `json:"intel"`
+	Encodings []*Encoding  `json:"encodings"`
+	CPUID     string       `json:"cpuid"`
+	CSV       *x86csv.Inst `json:"csv"`
+}
+
+// JSONLWriter writes tests as JSON Lines records.
+//
+// If Generator is set, the first record is a provenance header,
+// like {"provenance":["encoder: xed", ...]}.
+type JSONLWriter struct {
+	// Generator is used to write provenance header. Optional.
+	Generator *GeneratorInfo
+}
+
+// WriteTests implements Writer interface.
+func (w *JSONLWriter) WriteTests(name string, tests []*TestLine) ([]*File, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	if w.Generator != nil {
+		if err := enc.Encode(jsonlProvenance{Provenance: w.Generator.Provenance()}); err != nil {
+			return nil, err
+		}
+	}
+	for _, test := range tests {
+		err := enc.Encode(jsonlRecord{
+			Go:        test.Asm,
+			Intel:     test.Intel,
+			Encodings: test.Encodings,
+			CPUID:     test.CPUID,
+			CSV:       test.Inst,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return []*File{{Name: name + ".jsonl", Data: buf.Bytes(), jsonHeader: w.Generator != nil}}, nil
+}
@@ -0,0 +1,109 @@
+package avx512gen
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// GasWriter writes tests in GNU binutils gas testsuite format:
+// a source file (.s) and objdump expectations file (.d).
+//
+// The first test encoding is used as the only expected encoding.
+//
+// In .d files, "#key: value" lines are testsuite directives,
+// so the provenance header uses "##" comments there.
+//
+// Branch target labels are defined as local ".L" labels right
+// after the branch, so objdump prints targets as "<_start+0x...>".
+// Relaxable branches are forced to their rel32 form with {disp32}.
+type GasWriter struct {
+	// Mode is a machine mode tests were generated for.
+	// Mode32 tests are written in gas/i386 (not x86-64) style.
+	Mode MachineMode
+
+	// Generator is used to write provenance header. Optional.
+	Generator *GeneratorInfo
+}
+
+// WriteTests implements Writer interface.
+func (w *GasWriter) WriteTests(name string, tests []*TestLine) ([]*File, error) {
+	cpuid := tests[0].CPUID
+	if tests[0].Label != "" {
+		cpuid = name // Branch tests have different CPUIDs
+	}
+	bits, arch := "64bit", "x86_64"
+	if w.Mode == Mode32 {
+		bits, arch = "32bit", "i386"
+	} else {
+		name = "x86-64-" + name
+	}
+
+	var src bytes.Buffer
+	src.WriteString("# Code generated by avx512test. DO NOT EDIT.\n")
+	src.WriteString(provenanceHeader(w.Generator, "#"))
+	fmt.Fprintf(&src, "# Check %s %s instructions\n\n", bits, cpuid)
+	src.WriteString("\t.allow_index_reg\n")
+	src.WriteString("\t.text\n")
+	src.WriteString("_start:\n")
+
+	var dump bytes.Buffer
+	dump.WriteString("## Code generated by avx512test. DO NOT EDIT.\n")
+	dump.WriteString(provenanceHeader(w.Generator, "##"))
+	dump.WriteString("#as:\n")
+	dump.WriteString("#objdump: -dw\n")
+	fmt.Fprintf(&dump, "#name: %s %s insns\n", arch, cpuid)
+	fmt.Fprintf(&dump, "#source: %s.s\n\n", name)
+	dump.WriteString(".*: +file format .*\n\n\n")
+	dump.WriteString("Disassembly of section \\.text:\n\n")
+	dump.WriteString("0+ <_start>:\n")
+
+	for _, test := range tests {
+		code, err := hex.DecodeString(test.Encodings[0].Hex)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", test.Asm, err)
+		}
+		octets := make([]string, len(code))
+		for i, b := range code {
+			octets[i] = fmt.Sprintf("%02x", b)
+		}
+
+		if test.Label == "" {
+			fmt.Fprintf(&src, "\t%s\n", test.GNU)
+			fmt.Fprintf(&dump, "[ \t]*[a-f0-9]+:[ \t]*%s[ \t]*%s\n",
+				strings.Join(octets, " "), regexp.QuoteMeta(test.Objdump))
+			continue
+		}
+
+		// The expected bytes check that the target is the next
+		// instruction and that the requested branch form is used.
+		prefix := ""
+		if test.Relaxable() {
+			prefix = "{disp32} "
+		}
+		label := ".L" + test.Label
+		mnemonic := strings.TrimSuffix(test.Objdump, " "+test.Label)
+		fmt.Fprintf(&src, "\t%s%s\n", prefix, strings.TrimSuffix(test.GNU, test.Label)+label)
+		fmt.Fprintf(&src, "%s:\n", label)
+		if branchHasSuffix(mnemonic, w.Mode) {
+			mnemonic = regexp.QuoteMeta(mnemonic) + "q?"
+		} else {
+			mnemonic = regexp.QuoteMeta(mnemonic)
+		}
+		fmt.Fprintf(&dump, "[ \t]*[a-f0-9]+:[ \t]*%s[ \t]*%s[ \t]+[a-f0-9]+ <_start\\+0x[a-f0-9]+>\n",
+			strings.Join(octets, " "), mnemonic)
+	}
+
+	return []*File{
+		{Name: name + ".s", Data: src.Bytes(), Comment: "#"},
+		{Name: name + ".d", Data: dump.Bytes(), Comment: "##"},
+	}, nil
+}
+
+// branchHasSuffix reports whether some objdump and llvm-mc versions
+// print mnemonic with "q" suffix, like "callq" or "jmpq".
+func branchHasSuffix(mnemonic string, mode MachineMode) bool {
+	return mode == Mode64 && (mnemonic == "call" || mnemonic == "jmp")
+}
@@ -0,0 +1,77 @@
+package avx512gen
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"go/format"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// GoTableWriter writes tests as a Go table inside _test.go file.
+//
+// Every CPUID gets its own file and table variable.
+type GoTableWriter struct {
+	// Package is a Go package name of the output files.
+	Package string
+
+	// Generator is used to write provenance header. Optional.
+	Generator *GeneratorInfo
+}
+
+// WriteTests implements Writer interface.
+func (w *GoTableWriter) WriteTests(name string, tests []*TestLine) ([]*File, error) {
+	var buf bytes.Buffer
+	buf.WriteString("// Code generated by avx512test. DO NOT EDIT.\n")
+	buf.WriteString(provenanceHeader(w.Generator, "//"))
+	buf.WriteString("\n")
+	fmt.Fprintf(&buf, "package %s\n\n", w.Package)
+	fmt.Fprintf(&buf, "var %sTests = []struct {\n", goTableIdent(name))
+	buf.WriteString("Go    string\n")
+	buf.WriteString("Intel string\n")
+	buf.WriteString("Enc   [][]byte\n")
+	buf.WriteString("CPUID string\n")
+	buf.WriteString("}{\n")
+	for _, test := range tests {
+		buf.WriteString("{\n")
+		fmt.Fprintf(&buf, "Go: %q,\n", test.Asm)
+		fmt.Fprintf(&buf, "Intel: %q,\n", test.Intel)
+		buf.WriteString("Enc: [][]byte{\n")
+		for _, enc := range test.Encodings {
+			code, err := hex.DecodeString(enc.Hex)
+			if err != nil {
+				return nil, fmt.Errorf("%q: %v", test.Asm, err)
+			}
+			octets := make([]string, len(code))
+			for i, b := range code {
+				octets[i] = fmt.Sprintf("0x%02x", b)
+			}
+			fmt.Fprintf(&buf, "{%s},\n", strings.Join(octets, ", "))
+		}
+		buf.WriteString("},\n")
+		fmt.Fprintf(&buf, "CPUID: %q,\n", test.CPUID)
+		buf.WriteString("},\n")
+	}
+	buf.WriteString("}\n")
+
+	code, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("gofmt: %v", err)
+	}
+	return []*File{{Name: name + "_test.go", Data: code, Comment: "//"}}, nil
+}
+
+// goTableIdent converts file name to Go identifier: "aes_avx512f" => "aesAvx512f".
+func goTableIdent(name string) string {
+	parts := strings.Split(name, "_")
+	for i := 1; i < len(parts); i++ {
+		r, size := utf8.DecodeRuneInString(parts[i])
+		if size == 0 {
+			continue
+		}
+		parts[i] = string(unicode.ToUpper(r)) + parts[i][size:]
+	}
+	return strings.Join(parts, "")
+}
@@ -0,0 +1,160 @@
+package avx512gen
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/quasilyte/avx512test/internal/x86encode"
+)
+
+// llvmFeatureOverrides maps x86.csv CPUID feature to LLVM -mattr feature name
+// for the cases where simple lowercasing is not enough.
+var llvmFeatureOverrides = map[string]string{
+	"AES": "vaes", // EVEX-encoded AES requires VAES
+}
+
+func llvmFeature(cpuid string) string {
+	if feature := llvmFeatureOverrides[cpuid]; feature != "" {
+		return feature
+	}
+	return strings.ToLower(strings.Replace(cpuid, "_", "", -1))
+}
+
+// llvmFeatures returns -mattr flag value that enables all features
+// that are required to assemble tests.
+func llvmFeatures(tests []*TestLine) string {
+	seen := map[string]bool{}
+	var features []string
+	for _, test := range tests {
+		if test.Inst.CPUID == "" {
+			continue // Like most of the branch tests
+		}
+		for _, cpuid := range strings.Split(test.Inst.CPUID, "+") {
+			feature := "+" + llvmFeature(cpuid)
+			if !seen[feature] {
+				seen[feature] = true
+				features = append(features, feature)
+			}
+		}
+	}
+	sort.Strings(features)
+	return strings.Join(features, ",")
+}
+
+// llvmEncodingString formats code in a way llvm-mc -show-encoding does,
+// like "[0x62,0xf1,0xd5,0x4b,0x58,0xc6]".
+func llvmEncodingString(code []byte) string {
+	octets := make([]string, len(code))
+	for i, b := range code {
+		octets[i] = fmt.Sprintf("0x%02x", b)
+	}
+	return "[" + strings.Join(octets, ",") + "]"
+}
+
+// llvmFixupEncodingString is like llvmEncodingString, but the last n
+// bytes are printed as "A", like "[0xeb,A]". That's how llvm-mc shows
+// bytes that are filled by a label fixup.
+func llvmFixupEncodingString(code []byte, n int) string {
+	octets := make([]string, len(code))
+	for i, b := range code {
+		octets[i] = fmt.Sprintf("0x%02x", b)
+		if i >= len(code)-n {
+			octets[i] = "A"
+		}
+	}
+	return "[" + strings.Join(octets, ",") + "]"
+}
+
+// LLVMWriter writes tests in LLVM MC test suite format.
+//
+// Instruction text is produced by XED formatter from the first test encoding,
+// which is also used as the only expected encoding.
+//
+// Branch tests use GNU syntax text instead, as their only operand
+// is a target label. The label is defined right after the branch,
+// relaxable branches are forced to their rel32 form with {disp32}.
+type LLVMWriter struct {
+	// Syntax is an instruction text syntax: "att" or "intel".
+	Syntax string
+
+	// Mode is a machine mode tests were generated for.
+	// Mode32 tests use i386 triple.
+	Mode MachineMode
+
+	// Generator is used to write provenance header. Optional.
+	Generator *GeneratorInfo
+}
+
+// WriteTests implements Writer interface.
+func (w *LLVMWriter) WriteTests(name string, tests []*TestLine) ([]*File, error) {
+	syntax := x86encode.SyntaxATT
+	runFlags := ""
+	switch w.Syntax {
+	case "att":
+		// OK.
+	case "intel":
+		syntax = x86encode.SyntaxIntel
+		runFlags = "-x86-asm-syntax=intel -output-asm-variant=1 "
+	default:
+		return nil, fmt.Errorf("unknown LLVM syntax: %q", w.Syntax)
+	}
+	triple := "x86_64-unknown-unknown"
+	if w.Mode == Mode32 {
+		triple = "i386-unknown-unknown"
+	}
+	disasm, err := x86encode.New(x86encode.Options{Mode: w.Mode})
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("// Code generated by avx512test. DO NOT EDIT.\n")
+	buf.WriteString(provenanceHeader(w.Generator, "//"))
+	buf.WriteString("\n")
+	fmt.Fprintf(&buf, "// RUN: llvm-mc -triple %s -mattr=%s %s--show-encoding %%s | FileCheck %%s\n",
+		triple, llvmFeatures(tests), runFlags)
+
+	for _, test := range tests {
+		code, err := hex.DecodeString(test.Encodings[0].Hex)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", test.Asm, err)
+		}
+		if test.Label != "" {
+			w.writeBranch(&buf, test, code)
+			continue
+		}
+		text, err := disasm.Disassemble(code, syntax)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", test.Asm, err)
+		}
+		fmt.Fprintf(&buf, "\n// CHECK: %s\n", text)
+		fmt.Fprintf(&buf, "// CHECK: encoding: %s\n", llvmEncodingString(code))
+		fmt.Fprintf(&buf, "          %s\n", text)
+	}
+
+	return []*File{{Name: name + "_" + w.Syntax + ".s", Data: buf.Bytes(), Comment: "//"}}, nil
+}
+
+// writeBranch writes branch test along with its target label definition.
+func (w *LLVMWriter) writeBranch(buf *bytes.Buffer, test *TestLine, code []byte) {
+	prefix := ""
+	if test.Relaxable() {
+		prefix = "{disp32} "
+	}
+	dispSize := 1
+	if test.Inst.IntelArgs()[0] == "rel32" {
+		dispSize = 4
+	}
+	mnemonic := strings.TrimSuffix(test.GNU, " "+test.Label)
+	check := mnemonic
+	if w.Syntax == "att" && branchHasSuffix(mnemonic, w.Mode) {
+		check += "{{q?}}"
+	}
+	fmt.Fprintf(buf, "\n// CHECK: %s %s\n", check, test.Label)
+	fmt.Fprintf(buf, "// CHECK: encoding: %s\n", llvmFixupEncodingString(code, dispSize))
+	fmt.Fprintf(buf, "          %s%s\n", prefix, test.GNU)
+	fmt.Fprintf(buf, "%s:\n", test.Label)
+}
@@ -0,0 +1,110 @@
+package avx512gen
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// GeneratorInfo holds metadata about the generator invocation.
+type GeneratorInfo struct {
+	// Args is a list of command-line arguments, excluding program name.
+	Args []string
+
+	// X86CSV is a path to the x86.csv file that was used.
+	X86CSV string
+
+	// X86CSVVersion is x86.csv version taken from its header comment,
+	// like "x86 instruction set description version 0.2x, 2018-05-08".
+	X86CSVVersion string
+
+	// X86CSVHash is a hex-encoded SHA-256 of the x86.csv file contents.
+	X86CSVHash string
+
+	// Encoder is a name of the encoder backend, like "xed" or "go".
+	Encoder string
+
+	// XEDVersion is a version string of the XED library.
+	// Empty if encodings were not produced by XED,
+	// either directly or through a recorded fixture.
+	XEDVersion string
+
+	// Flags lists output-affecting flags that were set explicitly.
+	Flags []string
+}
+
+// Provenance returns "key: value" lines that describe
+// the inputs that produced the generated files.
+// Returns nil for nil info.
+func (info *GeneratorInfo) Provenance() []string {
+	if info == nil {
+		return nil
+	}
+	lines := []string{"encoder: " + info.Encoder}
+	if info.XEDVersion != "" {
+		lines = append(lines, "xed: "+info.XEDVersion)
+	}
+	return append(lines,
+		"x86.csv: "+info.X86CSVVersion,
+		"x86.csv sha256: "+info.X86CSVHash,
+		"flags: "+strings.Join(info.Flags, " "),
+	)
+}
+
+// provenanceHeader returns provenance lines prefixed by the
+// specified comment token.
+func provenanceHeader(info *GeneratorInfo, comment string) string {
+	var buf strings.Builder
+	for _, line := range info.Provenance() {
+		buf.WriteString(comment + " " + line + "\n")
+	}
+	return buf.String()
+}
+
+// jsonlProvenance is the leading JSONLWriter record.
+type jsonlProvenance struct {
+	Provenance []string `json:"provenance"`
+}
+
+// HasProvenance reports whether f has a provenance header.
+func (f *File) HasProvenance() bool {
+	return f.jsonHeader || f.Comment != ""
+}
+
+// ParseProvenance returns provenance header of data, which is expected
+// to be a previously written version of f, as a key => value map.
+// Only the header part of data is parsed.
+// Returns nil if f has no provenance header.
+func (f *File) ParseProvenance(data []byte) map[string]string {
+	var lines []string
+	switch {
+	case f.jsonHeader:
+		if i := bytes.IndexByte(data, '\n'); i != -1 {
+			data = data[:i]
+		}
+		var record jsonlProvenance
+		if err := json.Unmarshal(data, &record); err == nil {
+			lines = record.Provenance
+		}
+	case f.Comment != "":
+		// The header ends at the first non-comment line.
+		prefix := f.Comment + " "
+		for _, line := range strings.Split(string(data), "\n") {
+			if !strings.HasPrefix(line, prefix) {
+				break
+			}
+			lines = append(lines, strings.TrimPrefix(line, prefix))
+		}
+	default:
+		return nil
+	}
+
+	header := map[string]string{}
+	for _, line := range lines {
+		parts := strings.SplitN(line, ": ", 2)
+		if len(parts) == 2 {
+			header[parts[0]] = parts[1]
+		}
+	}
+	return header
+}
@@ -0,0 +1,46 @@
+package avx512gen
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"golang.org/x/arch/x86/x86csv"
+)
+
+// InstSource provides instructions for tests generation.
+type InstSource interface {
+	// Insts returns all known instruction forms.
+	Insts() ([]*x86csv.Inst, error)
+}
+
+// CSVSource is an InstSource that reads x86.csv file contents.
+type CSVSource struct {
+	// Data is x86.csv file contents.
+	Data []byte
+}
+
+// Insts implements InstSource interface.
+func (src *CSVSource) Insts() ([]*x86csv.Inst, error) {
+	insts, err := x86csv.NewReader(bytes.NewReader(src.Data)).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("decode x86csv: %v", err)
+	}
+	return insts, nil
+}
+
+// Version returns x86.csv version from the first header line,
+// like "x86 instruction set description version 0.2x, 2018-05-08".
+func (src *CSVSource) Version() string {
+	line := src.Data
+	if i := bytes.IndexByte(line, '\n'); i != -1 {
+		line = line[:i]
+	}
+	return strings.TrimSpace(strings.TrimPrefix(string(line), "#"))
+}
+
+// Hash returns hex-encoded SHA-256 of x86.csv contents.
+func (src *CSVSource) Hash() string {
+	return fmt.Sprintf("%x", sha256.Sum256(src.Data))
+}
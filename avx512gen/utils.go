@@ -0,0 +1,324 @@
+package avx512gen
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/quasilyte/avx512test/internal/x86encode"
+	"golang.org/x/arch/x86/x86csv"
+)
+
+func goAsmString(inst *x86csv.Inst, args []Arg) string {
+	return goAsmStringWithSuffix(inst, args, "")
+}
+
+// goAsmStringWithSuffix is like goAsmString, but appends opcode suffix,
+// like ".BCST", to the instruction opcode.
+func goAsmStringWithSuffix(inst *x86csv.Inst, args []Arg, suffix string) string {
+	op := inst.GoOpcode() + suffix
+	if len(args) == 0 {
+		return op
+	}
+
+	// Collect args in reverse.
+	goArgs := make([]string, 0, len(args))
+	for i := len(args) - 1; i >= 0; i-- {
+		goArgs = append(goArgs, args[i].GoSyntax)
+	}
+
+	return op + " " + strings.Join(goArgs, ", ")
+}
+
+// intelAsmString returns Intel syntax asm string for inst with given args.
+// If bcst is true, memory operand is formatted as embedded broadcast.
+func intelAsmString(inst *x86csv.Inst, args []Arg, bcst bool) string {
+	op := inst.IntelOpcode()
+	if len(args) == 0 {
+		return op
+	}
+
+	csvArgs := inst.IntelArgs()
+	var intelArgs []string
+	for i, arg := range args {
+		var s string
+		switch data := arg.Data.(type) {
+		case *x86encode.RegArgument:
+			s = data.Name
+			if strings.HasSuffix(csvArgs[i], "+3") {
+				s += "+3"
+			}
+		case *x86encode.ImmArgument:
+			s = fmt.Sprint(data.Value)
+		case *x86encode.RelArgument:
+			s = data.Label
+		case *x86encode.PtrArgument:
+			s = fmt.Sprintf("%#x:%#x", data.Selector, data.Offset)
+		case *x86encode.MemArgument:
+			s = intelMemoryExpression(data)
+			if bcst {
+				vl := vlBits(instVL(inst)[0])
+				s += fmt.Sprintf("{1to%d}", vl/int(data.Width))
+			}
+		}
+
+		// Opmask operands are attached to the previous operand.
+		if strings.HasPrefix(csvArgs[i], "{k") && len(intelArgs) != 0 {
+			intelArgs[len(intelArgs)-1] += " {" + s + "}"
+			continue
+		}
+		intelArgs = append(intelArgs, s)
+	}
+
+	return op + " " + strings.Join(intelArgs, ", ")
+}
+
+func instREXW(inst *x86csv.Inst) []x86encode.InstParam {
+	switch {
+	case strings.Contains(inst.Encoding, ".WIG"):
+		return []x86encode.InstParam{x86encode.ParamRexW0, x86encode.ParamRexW1}
+	case strings.Contains(inst.Encoding, ".W1"):
+		return []x86encode.InstParam{x86encode.ParamRexW1}
+	default:
+		return []x86encode.InstParam{x86encode.ParamRexW0}
+	}
+}
+
+func instVL(inst *x86csv.Inst) []x86encode.InstParam {
+	switch {
+	case strings.Contains(inst.Encoding, ".LIG"):
+		if evexEncoded(inst) {
+			return []x86encode.InstParam{
+				x86encode.ParamVexL128,
+				x86encode.ParamVexL256,
+				x86encode.ParamVexL512,
+			}
+		}
+		return []x86encode.InstParam{x86encode.ParamVexL128, x86encode.ParamVexL256}
+	case strings.Contains(inst.Encoding, ".512"):
+		return []x86encode.InstParam{x86encode.ParamVexL512}
+	case strings.Contains(inst.Encoding, ".256"):
+		return []x86encode.InstParam{x86encode.ParamVexL256}
+	default:
+		return []x86encode.InstParam{x86encode.ParamVexL128}
+	}
+}
+
+// vlBits returns vector length in bits for VL encoder param.
+func vlBits(vl x86encode.InstParam) int {
+	switch vl {
+	case x86encode.ParamVexL256:
+		return 256
+	case x86encode.ParamVexL512:
+		return 512
+	default:
+		return 128
+	}
+}
+
+// rexwBit returns W bit value for REX.W encoder param.
+func rexwBit(rexw x86encode.InstParam) int {
+	if rexw == x86encode.ParamRexW1 {
+		return 1
+	}
+	return 0
+}
+
+// isBranchInst reports whether inst is a relative branch
+// form with rel8 or rel32 operand.
+func isBranchInst(inst *x86csv.Inst) bool {
+	args := inst.IntelArgs()
+	return len(args) == 1 && (args[0] == "rel8" || args[0] == "rel32")
+}
+
+// relLabel returns branch target label from args.
+// Returns empty string if there is no rel operand.
+func relLabel(args []Arg) string {
+	for _, arg := range args {
+		if rel, ok := arg.Data.(*x86encode.RelArgument); ok {
+			return rel.Label
+		}
+	}
+	return ""
+}
+
+// instHasTag reports whether inst x86.csv tags include tag.
+func instHasTag(inst *x86csv.Inst, tag string) bool {
+	for _, t := range strings.Split(inst.Tags, ",") {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func evexEncoded(inst *x86csv.Inst) bool {
+	return strings.HasPrefix(inst.Encoding, "EVEX")
+}
+
+// cpuidFilenameOverrides maps x86.csv CPUID to the output file name
+// for the cases where automatically derived name is not appropriate.
+//
+// See cpuidFilename.
+var cpuidFilenameOverrides = map[string]string{}
+
+var cpuidFeatureRE = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+
+// cpuidFilename returns output file name (without extension) for x86.csv CPUID.
+//
+// Unless CPUID has an entry in cpuidFilenameOverrides,
+// the name is derived from the CPUID features:
+//
+//	"AVX512F+AVX512VL"     => "avx512f"
+//	"AVX512_VBMI+AVX512VL" => "avx512_vbmi"
+//	"GFNI+AVX512F"         => "gfni_avx512f"
+//	"GFNI+AVX512VL"        => "gfni_avx512f"
+//
+// Features are sorted, so their order in CPUID does not matter:
+//
+//	"VAES+GFNI+AVX512F"    => "gfni_vaes_avx512f"
+func cpuidFilename(cpuid string) (string, error) {
+	if name := cpuidFilenameOverrides[cpuid]; name != "" {
+		return name, nil
+	}
+	if cpuid == "" {
+		return "", errors.New("can't derive file name from empty CPUID")
+	}
+
+	var features []string
+	baseAVX512 := false // Whether AVX512F or AVX512VL is required
+	for _, feature := range strings.Split(cpuid, "+") {
+		switch {
+		case feature == "AVX512F" || feature == "AVX512VL":
+			baseAVX512 = true
+		case cpuidFeatureRE.MatchString(feature):
+			features = append(features, feature)
+		default:
+			return "", fmt.Errorf("can't derive file name from %q CPUID: bad feature %q",
+				cpuid, feature)
+		}
+	}
+
+	if len(features) == 0 {
+		return "avx512f", nil
+	}
+	sort.Strings(features)
+
+	name := strings.ToLower(strings.Join(features, "_"))
+	if baseAVX512 && !strings.HasPrefix(features[0], "AVX512") {
+		// Non-AVX512 extension that is used with EVEX encoding.
+		name += "_avx512f"
+	}
+	return name, nil
+}
+
+func normalizeCPUID(cpuid string) string {
+	cpuid = strings.Replace(cpuid, "+AVX512VL", "", 1)
+	cpuid = strings.Replace(cpuid, "+AVX512F", "", 1)
+	return cpuid
+}
+
+// instDispScale returns disp8*N compression factor (N) for inst memory operand.
+// If bcst is true, N for embedded broadcast form is returned.
+//
+// Returns 0 for instructions that have no compressed displacement.
+func instDispScale(inst *x86csv.Inst, bcst bool) int {
+	prefix := "scale"
+	if bcst {
+		prefix = "bscale"
+	}
+	for _, tag := range strings.Split(inst.Tags, ",") {
+		if !strings.HasPrefix(tag, prefix) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(tag, prefix))
+		if err != nil {
+			continue
+		}
+		return n
+	}
+	return 0
+}
+
+// dispWidth returns displacement encoding that is expected for disp
+// under disp8*N compression with given n.
+// For n=0, no compression is assumed.
+func dispWidth(disp int32, n int) x86encode.DisplacementKind {
+	switch {
+	case n == 0 || disp == 0:
+		return x86encode.DispSmallest
+	case disp%int32(n) == 0 && disp/int32(n) >= -128 && disp/int32(n) <= 127:
+		return x86encode.Disp8
+	default:
+		return x86encode.Disp32
+	}
+}
+
+// disp8TestDisplacements returns displacements that cover
+// disp8*N encoding boundaries for given n.
+func disp8TestDisplacements(n int) []int32 {
+	n32 := int32(n)
+	disps := []int32{
+		0,
+		n32,
+		-n32,
+		127 * n32,
+		-128 * n32,
+		128 * n32,
+		-129 * n32,
+	}
+	if n > 1 {
+		// Non-multiples of N can't be compressed.
+		disps = append(disps, n32+1, -(n32 + 1), 127*n32+1)
+	}
+	return disps
+}
+
+func isVectorReg(name string) bool {
+	return strings.HasPrefix(name, "XMM") ||
+		strings.HasPrefix(name, "YMM") ||
+		strings.HasPrefix(name, "ZMM")
+}
+
+// gatherIndexConflict reports whether argList of gather instruction
+// uses the same vector register as VSIB index and as destination.
+// Such instructions are invalid (#UD).
+//
+// Built-in 64-bit mode tables never produce such args,
+// but converted 32-bit mode tables do.
+func gatherIndexConflict(inst *x86csv.Inst, argList []Arg) bool {
+	op := inst.IntelOpcode()
+	if !strings.Contains(op, "GATHER") || strings.Contains(op, "GATHERPF") {
+		return false
+	}
+	index := ""
+	for _, arg := range argList {
+		if mem, ok := arg.Data.(*x86encode.MemArgument); ok && isVectorReg(mem.Index) {
+			index = mem.Index[len("XMM"):]
+		}
+	}
+	if index == "" {
+		return false
+	}
+	for _, arg := range argList {
+		if reg, ok := arg.Data.(*x86encode.RegArgument); ok &&
+			isVectorReg(reg.Name) && reg.Name[len("XMM"):] == index {
+			return true
+		}
+	}
+	return false
+}
+
+// isDataError reports whether encoder error is caused by
+// mistakes in the input data (like unknown register names or
+// stale encoder fixture) as opposed to invalid instruction
+// forms rejected by the encoder.
+func isDataError(err error) bool {
+	var unknownReg *x86encode.ErrUnknownRegister
+	return errors.Is(err, x86encode.ErrUnknownOpcode) ||
+		errors.Is(err, x86encode.ErrNotRecorded) ||
+		errors.As(err, &unknownReg)
+}
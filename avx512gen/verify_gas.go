@@ -0,0 +1,208 @@
+package avx512gen
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// GasMode selects how VerifyWithGas handles encoding mismatches.
+type GasMode int
+
+const (
+	// GasMerge adds gas encoding to the test "or" list.
+	GasMerge GasMode = iota
+
+	// GasFlag reports mismatching encodings as failures.
+	GasFlag
+)
+
+// VerifyWithGas cross-validates test encodings against GNU as
+// that is located at asPath.
+//
+// Every test line is assembled from its GNU syntax form.
+// Depending on mode, mismatching gas encoding is either
+// merged into the "or" list or reported as a failure.
+// Failures are reported via cfg.OnFailure.
+// Tests are assembled for cfg.Mode machine mode.
+func VerifyWithGas(cfg *Config, tests []*TestLine, asPath string, mode GasMode) error {
+	lines := make([]string, len(tests))
+	for i, test := range tests {
+		lines[i] = test.GNU
+	}
+	codes, rejected, err := gasEncode(asPath, cfg.Mode, lines)
+	if err != nil {
+		return err
+	}
+
+	for i, test := range tests {
+		if msg, ok := rejected[i]; ok {
+			addGasFailure(cfg, test, "gas rejected: "+msg)
+			continue
+		}
+
+		gasEnc := fmt.Sprintf("%x", codes[i])
+		if test.HasEncoding(gasEnc) {
+			continue
+		}
+
+		switch mode {
+		case GasMerge:
+			cfg.debugf("%q: merge gas encoding %s", test.Asm, gasEnc)
+			test.Enc += " or " + gasEnc
+			test.Encodings = append(test.Encodings, &Encoding{
+				Hex:    gasEnc,
+				Source: "gas",
+			})
+		case GasFlag:
+			addGasFailure(cfg, test, "gas mismatch: "+gasEnc)
+		}
+	}
+
+	return nil
+}
+
+func addGasFailure(cfg *Config, test *TestLine, reason string) {
+	cfg.debugf("%q: %s", test.Asm, reason)
+	cfg.addFailure(&Failure{
+		Opcode: test.Inst.IntelOpcode(),
+		Reason: strings.SplitN(reason, ":", 2)[0],
+		Test:   test.GNU + " // " + reason,
+	})
+}
+
+// gasErrorRE matches GNU as error message line.
+var gasErrorRE = regexp.MustCompile(`^.*\.s:(\d+): Error: (.*)$`)
+
+// gasEncode assembles every line with GNU as and returns
+// machine code for each of them.
+//
+// Lines that are rejected by the assembler are reported
+// inside rejected map (line index -> error message).
+func gasEncode(asPath string, mode MachineMode, lines []string) (codes [][]byte, rejected map[int]string, err error) {
+	dir, err := ioutil.TempDir("", "avx512test")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "gas.s")
+	obj := filepath.Join(dir, "gas.o")
+
+	rejected = map[int]string{}
+	// Every rejected line is removed and assembler is re-run.
+	// The second failure is fatal.
+	for attempt := 0; ; attempt++ {
+		if err := ioutil.WriteFile(src, gasSource(lines, rejected), 0644); err != nil {
+			return nil, nil, err
+		}
+		var stderr bytes.Buffer
+		cmd := exec.Command(asPath, fmt.Sprintf("--%d", mode.Bits()), "-o", obj, src)
+		cmd.Stderr = &stderr
+		runErr := cmd.Run()
+		if runErr == nil {
+			break
+		}
+		if attempt != 0 {
+			return nil, nil, fmt.Errorf("run %s: %v: %s", asPath, runErr, stderr.String())
+		}
+		if !collectGasErrors(&stderr, rejected) {
+			return nil, nil, fmt.Errorf("run %s: %v: %s", asPath, runErr, stderr.String())
+		}
+	}
+
+	codes, err = gasObjectCodes(obj, len(lines))
+	return codes, rejected, err
+}
+
+// gasSource returns GNU as source where every line is preceded
+// by a label that is used to find its code inside the object file.
+//
+// Source line number of lines[i] is i*2+3.
+func gasSource(lines []string, rejected map[int]string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("\t.text\n")
+	for i, line := range lines {
+		if _, ok := rejected[i]; ok {
+			line = ""
+		}
+		fmt.Fprintf(&buf, "avx512test_%d:\n\t%s\n", i, line)
+	}
+	fmt.Fprintf(&buf, "avx512test_%d:\n", len(lines))
+	return buf.Bytes()
+}
+
+// collectGasErrors parses GNU as stderr and adds rejected lines to the map.
+// Returns false if no errors were recognized.
+func collectGasErrors(stderr *bytes.Buffer, rejected map[int]string) bool {
+	found := false
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		m := gasErrorRE.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		lineNum, err := strconv.Atoi(m[1])
+		if err != nil || lineNum < 3 || (lineNum-3)%2 != 0 {
+			continue
+		}
+		rejected[(lineNum-3)/2] = m[2]
+		found = true
+	}
+	return found
+}
+
+// gasObjectCodes extracts code of n labeled instructions from ELF object.
+func gasObjectCodes(filename string, n int) ([][]byte, error) {
+	f, err := elf.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	text := f.Section(".text")
+	if text == nil {
+		return nil, fmt.Errorf("%s: no .text section", filename)
+	}
+	data, err := text.Data()
+	if err != nil {
+		return nil, err
+	}
+	symbols, err := f.Symbols()
+	if err != nil {
+		return nil, err
+	}
+
+	offsets := make([]int, n+1)
+	for i := range offsets {
+		offsets[i] = -1
+	}
+	for _, sym := range symbols {
+		if !strings.HasPrefix(sym.Name, "avx512test_") {
+			continue
+		}
+		i, err := strconv.Atoi(strings.TrimPrefix(sym.Name, "avx512test_"))
+		if err != nil || i < 0 || i > n {
+			continue
+		}
+		offsets[i] = int(sym.Value)
+	}
+
+	codes := make([][]byte, n)
+	for i := range codes {
+		from, to := offsets[i], offsets[i+1]
+		if from < 0 || to < from || to > len(data) {
+			return nil, fmt.Errorf("%s: bad avx512test_%d label offset", filename, i)
+		}
+		codes[i] = data[from:to]
+	}
+	return codes, nil
+}
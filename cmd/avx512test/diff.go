@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/quasilyte/avx512test/avx512gen"
+)
+
+// testFileDiff describes differences between existing and generated test file.
+type testFileDiff struct {
+	filename string
+	added    []string
+	removed  []string
+	changed  []string
+}
+
+func (d *testFileDiff) empty() bool {
+	return len(d.added) == 0 && len(d.removed) == 0 && len(d.changed) == 0
+}
+
+// diffOutput compares generated tests with existing Go assembler
+// test files from -diff directory.
+//
+// Test lines are matched by their Go syntax.
+func (ctx *context) diffOutput() error {
+	if ctx.args.diff == "" {
+		return nil
+	}
+
+	generated := avx512gen.GroupByFilename(ctx.tests)
+
+	existingFiles, err := filepath.Glob(filepath.Join(ctx.args.diff, "*.s"))
+	if err != nil {
+		return err
+	}
+	filenames := map[string]bool{}
+	for _, filename := range existingFiles {
+		filenames[strings.TrimSuffix(filepath.Base(filename), ".s")] = true
+	}
+	for filename := range generated {
+		filenames[filename] = true
+	}
+	sortedFilenames := make([]string, 0, len(filenames))
+	for filename := range filenames {
+		sortedFilenames = append(sortedFilenames, filename)
+	}
+	sort.Strings(sortedFilenames)
+
+	for _, filename := range sortedFilenames {
+		existing, err := readAsmTestFile(filepath.Join(ctx.args.diff, filename+".s"))
+		if err != nil {
+			return err
+		}
+		d := diffTests(existing, generated[filename])
+		d.filename = filename + ".s"
+		printTestFileDiff(d)
+		if !d.empty() {
+			ctx.diffs++
+		}
+	}
+
+	return nil
+}
+
+// checkDiff returns an error if diffOutput found differences.
+// It runs after the failures report, so the report is not lost.
+func (ctx *context) checkDiff() error {
+	if ctx.diffs != 0 {
+		return fmt.Errorf("%d file(s) differ from %s", ctx.diffs, ctx.args.diff)
+	}
+	return nil
+}
+
+func diffTests(existing map[string]string, generated []*avx512gen.TestLine) *testFileDiff {
+	var d testFileDiff
+
+	seen := make(map[string]bool, len(generated))
+	for _, test := range generated {
+		seen[test.Asm] = true
+		enc, ok := existing[test.Asm]
+		switch {
+		case !ok:
+			d.added = append(d.added, fmt.Sprintf("%s // %s", test.Asm, test.Enc))
+		case enc != test.Enc:
+			d.changed = append(d.changed, fmt.Sprintf("%s // %s => %s", test.Asm, enc, test.Enc))
+		}
+	}
+	for asm, enc := range existing {
+		if !seen[asm] {
+			d.removed = append(d.removed, fmt.Sprintf("%s // %s", asm, enc))
+		}
+	}
+	sort.Strings(d.removed)
+
+	return &d
+}
+
+func printTestFileDiff(d *testFileDiff) {
+	if d.empty() {
+		fmt.Printf("%s: no changes\n", d.filename)
+		return
+	}
+	fmt.Printf("%s: %d added, %d removed, %d changed\n",
+		d.filename, len(d.added), len(d.removed), len(d.changed))
+	for _, line := range d.added {
+		fmt.Printf("\t+ %s\n", line)
+	}
+	for _, line := range d.removed {
+		fmt.Printf("\t- %s\n", line)
+	}
+	for _, line := range d.changed {
+		fmt.Printf("\t~ %s\n", line)
+	}
+}
+
+// readAsmTestFile parses Go assembler test file and returns
+// encoding strings mapped by Go syntax asm string.
+//
+// Both normal and TODO-commented test lines are collected.
+// Returns empty map if file does not exist.
+func readAsmTestFile(filename string) (map[string]string, error) {
+	tests := map[string]string{}
+
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return tests, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		line = strings.TrimPrefix(line, "//TODO:")
+		if strings.HasPrefix(line, "//") {
+			continue // Ordinary comment
+		}
+		parts := strings.SplitN(line, "//", 2)
+		if len(parts) != 2 {
+			continue // Not a test line
+		}
+		tests[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return tests, scanner.Err()
+}
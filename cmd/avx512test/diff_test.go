@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/quasilyte/avx512test/avx512gen"
+)
+
+func TestReadAsmTestFile(t *testing.T) {
+	have, err := readAsmTestFile("testdata/diff/avx512f.s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"VADDPD Z2, Z1, Z0":        "62f1f54858c2",
+		"VADDPD Z3, Z1, Z0":        "62f1f54858c3",
+		"VADDPD.BCST (AX), Z1, Z0": "62f1f5585800",
+		"VADDPD.BCST (BX), Z1, Z0": "62f1f5585803",
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("tests mismatch:\nhave: %q\nwant: %q", have, want)
+	}
+
+	have, err = readAsmTestFile("testdata/diff/missing.s")
+	if err != nil || len(have) != 0 {
+		t.Errorf("missing file: expected empty result, got %q, %v", have, err)
+	}
+}
+
+func TestDiffTests(t *testing.T) {
+	existing, err := readAsmTestFile("testdata/diff/avx512f.s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated := []*avx512gen.TestLine{
+		{Asm: "VADDPD Z2, Z1, Z0", Enc: "62f1f54858c2"},
+		{Asm: "VADDPD Z3, Z1, Z0", Enc: "62f1f54858c3 or 62f1f54858cb"},
+		{Asm: "VADDPD.BCST (AX), Z1, Z0", Enc: "62f1f5585800"},
+		{Asm: "VADDPD Z4, Z1, Z0", Enc: "62f1f54858c4"},
+	}
+
+	d := diffTests(existing, generated)
+	want := &testFileDiff{
+		added:   []string{"VADDPD Z4, Z1, Z0 // 62f1f54858c4"},
+		removed: []string{"VADDPD.BCST (BX), Z1, Z0 // 62f1f5585803"},
+		changed: []string{"VADDPD Z3, Z1, Z0 // 62f1f54858c3 => 62f1f54858c3 or 62f1f54858cb"},
+	}
+	if !reflect.DeepEqual(d, want) {
+		t.Errorf("diff mismatch:\nhave: %+v\nwant: %+v", d, want)
+	}
+
+	if d := diffTests(existing, nil); len(d.removed) != len(existing) || d.empty() {
+		t.Errorf("no generated tests: expected all tests to be removed, got %+v", d)
+	}
+	if d := diffTests(existing, generated[:1]); len(d.added) != 0 || len(d.changed) != 0 {
+		t.Errorf("subset: unexpected added or changed tests: %+v", d)
+	}
+}
+
+func TestDiffOutput(t *testing.T) {
+	tests := []struct {
+		tests []*avx512gen.TestLine
+		diffs int
+	}{
+		{nil, 1}, // All existing tests are removed
+		{[]*avx512gen.TestLine{{Asm: "VADDPD Z2, Z1, Z0", Enc: "62f1f54858c2", Filename: "avx512f"}}, 1},
+	}
+
+	for _, test := range tests {
+		ctx := &context{
+			args:  &arguments{diff: "testdata/diff"},
+			tests: test.tests,
+		}
+		if err := ctx.diffOutput(); err != nil {
+			t.Fatal(err)
+		}
+		if ctx.diffs != test.diffs {
+			t.Errorf("diffs: have %d, want %d", ctx.diffs, test.diffs)
+		}
+		if err := ctx.checkDiff(); err == nil {
+			t.Errorf("expected an error for differences")
+		}
+	}
+
+	ctx := &context{args: &arguments{diff: "testdata/diff"}}
+	existing, err := readAsmTestFile("testdata/diff/avx512f.s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for asm, enc := range existing {
+		ctx.tests = append(ctx.tests, &avx512gen.TestLine{Asm: asm, Enc: enc, Filename: "avx512f"})
+	}
+	if err := ctx.diffOutput(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.checkDiff(); err != nil {
+		t.Errorf("same tests: unexpected error: %v", err)
+	}
+}
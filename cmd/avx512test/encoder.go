@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/quasilyte/avx512test/internal/x86encode"
+)
+
+// encoderBackends maps -encoder flag value to the associated encoder constructor.
+//
+// Constructors are called after x86.csv is read.
+var encoderBackends = map[string]func(ctx *context) (x86encode.Encoder, error){
+	"xed": func(ctx *context) (x86encode.Encoder, error) {
+		return x86encode.New(x86encode.Options{Mode: ctx.mode})
+	},
+	"go": func(ctx *context) (x86encode.Encoder, error) {
+		insts, err := ctx.source.Insts()
+		if err != nil {
+			return nil, err
+		}
+		return x86encode.NewGoEncoder(insts, ctx.mode), nil
+	},
+	"fixture": func(ctx *context) (x86encode.Encoder, error) {
+		if ctx.args.fixture == "" {
+			return nil, fmt.Errorf("-encoder=fixture requires -fixture")
+		}
+		f, err := os.Open(ctx.args.fixture)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		fixture, err := x86encode.LoadFixture(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", ctx.args.fixture, err)
+		}
+		if fixture.Mode() != ctx.mode {
+			return nil, fmt.Errorf("%s: recorded for %d-bit mode, but -mode=%d is used",
+				ctx.args.fixture, fixture.Mode().Bits(), ctx.mode.Bits())
+		}
+		// Fixture encodings come from the encoder they were recorded with.
+		ctx.generator.XEDVersion = fixture.XEDVersion()
+		return &x86encode.FixtureEncoder{Fixture: fixture}, nil
+	},
+}
+
+func (ctx *context) initEncoder() error {
+	encoder, err := encoderBackends[ctx.args.encoder](ctx)
+	if err != nil {
+		return err
+	}
+	ctx.encoder = encoder
+
+	if ctx.args.record != "" {
+		fixture := x86encode.NewFixture(ctx.mode)
+		fixture.SetXEDVersion(ctx.generator.XEDVersion)
+		ctx.recorder = &x86encode.RecordingEncoder{
+			Encoder: encoder,
+			Fixture: fixture,
+		}
+		ctx.encoder = ctx.recorder
+	}
+
+	return nil
+}
+
+func (ctx *context) writeFixture() error {
+	if ctx.recorder == nil {
+		return nil
+	}
+
+	f, err := os.Create(ctx.args.record)
+	if err != nil {
+		return err
+	}
+	if _, err := ctx.recorder.Fixture.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	ctx.debugf("recorded %d instructions to %s", ctx.recorder.Fixture.Len(), ctx.args.record)
+	return f.Close()
+}
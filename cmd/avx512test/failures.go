@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/quasilyte/avx512test/avx512gen"
+)
+
+// failureGroup is a set of failures with the same opcode and reason.
+type failureGroup struct {
+	Opcode string   `json:"opcode"`
+	Reason string   `json:"reason"`
+	Count  int      `json:"count"`
+	Tests  []string `json:"tests"`
+}
+
+func groupFailures(failures []*avx512gen.Failure) []*failureGroup {
+	type groupKey struct {
+		opcode string
+		reason string
+	}
+	var groups []*failureGroup
+	groupByKey := map[groupKey]*failureGroup{}
+	for _, f := range failures {
+		key := groupKey{opcode: f.Opcode, reason: f.Reason}
+		g := groupByKey[key]
+		if g == nil {
+			g = &failureGroup{Opcode: f.Opcode, Reason: f.Reason}
+			groupByKey[key] = g
+			groups = append(groups, g)
+		}
+		g.Count++
+		g.Tests = append(g.Tests, f.Test)
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		if groups[i].Count != groups[j].Count {
+			return groups[i].Count > groups[j].Count
+		}
+		if groups[i].Opcode != groups[j].Opcode {
+			return groups[i].Opcode < groups[j].Opcode
+		}
+		return groups[i].Reason < groups[j].Reason
+	})
+
+	return groups
+}
+
+func (ctx *context) reportFailures() error {
+	groups := groupFailures(ctx.failures)
+
+	if len(groups) != 0 {
+		fmt.Fprintf(os.Stderr, "encoder failures summary (%d total):\n", len(ctx.failures))
+		w := tabwriter.NewWriter(os.Stderr, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "COUNT\tOPCODE\tREASON")
+		for _, g := range groups {
+			fmt.Fprintf(w, "%d\t%s\t%s\n", g.Count, g.Opcode, g.Reason)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if ctx.args.failuresJSON != "" {
+		if groups == nil {
+			groups = []*failureGroup{}
+		}
+		data, err := json.MarshalIndent(groups, "", "  ")
+		if err != nil {
+			return fmt.Errorf("encode failures: %v", err)
+		}
+		if err := ioutil.WriteFile(ctx.args.failuresJSON, data, 0644); err != nil {
+			return fmt.Errorf("write failures: %v", err)
+		}
+	}
+
+	if ctx.args.maxFailures >= 0 && len(ctx.failures) > ctx.args.maxFailures {
+		return fmt.Errorf("too many encoder failures: %d (max is %d)",
+			len(ctx.failures), ctx.args.maxFailures)
+	}
+
+	return nil
+}
@@ -1,41 +1,63 @@
 package main
 
 import (
-	"bytes"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"path/filepath"
-	"sort"
-	"strings"
 	"text/template"
 
+	"github.com/quasilyte/avx512test/avx512gen"
 	"github.com/quasilyte/avx512test/internal/x86encode"
-	"golang.org/x/arch/x86/x86csv"
 )
 
 type arguments struct {
-	x86csv    string
-	output    string
-	debug     bool
-	commented bool
+	x86csv         string
+	output         string
+	format         string
+	llvmSyntax     string
+	gotablePackage string
+	template       string
+	include        string
+	symbolPrefix   string
+	split          string
+	maxLines       int
+	verifyGas      string
+	gasPath        string
+	debug          bool
+	commented      bool
+	failuresJSON   string
+	maxFailures    int
+	diff           string
+	config         string
+	encoder        string
+	fixture        string
+	record         string
+	jobs           int
+	mode           int
+	branches       bool
 }
 
 type context struct {
-	args  *arguments
-	insts []*x86csv.Inst
+	args *arguments
 
-	peeks map[string]int
+	mode x86encode.MachineMode
 
-	testLineByAsm map[string]*testLine
-}
+	argTable *avx512gen.ArgTable
+	encoder  x86encode.Encoder
+	recorder *x86encode.RecordingEncoder
+
+	source *avx512gen.CSVSource
+	tests  []*avx512gen.TestLine
+
+	asmTemplate *template.Template
 
-type testLine struct {
-	Asm   string // Asm string in Go syntax
-	Enc   string // Encoding string, can contain several or-separated encodings
-	cpuid string // Normalized CPUID
+	generator *avx512gen.GeneratorInfo
+
+	failures []*avx512gen.Failure
+
+	diffs int // Number of -diff files with differences
 }
 
 func main() {
@@ -47,11 +69,18 @@ func main() {
 	}{
 		{"parse flags", ctx.parseFlags},
 		{"init context", ctx.init},
+		{"load config", ctx.loadConfig},
+		{"load asm template", ctx.loadAsmTemplate},
 		{"prepare output dir", ctx.prepareOutputDir},
 		{"read x86 csv", ctx.readCSV},
-		{"filter insts", ctx.filterInsts},
+		{"init encoder", ctx.initEncoder},
 		{"generate tests", ctx.generateTests},
+		{"verify with gas", ctx.verifyGas},
+		{"diff output", ctx.diffOutput},
 		{"write output", ctx.writeOutput},
+		{"write fixture", ctx.writeFixture},
+		{"report failures", ctx.reportFailures},
+		{"check diff", ctx.checkDiff},
 	}
 
 	for _, step := range steps {
@@ -69,305 +98,191 @@ func (ctx *context) parseFlags() error {
 		`Where to find suitable x86.csv file`)
 	flag.StringVar(&args.output, "output", "output",
 		`Where to put generated encoder test files`)
+	flag.StringVar(&args.format, "format", "asm",
+		`Output format: asm (Go assembler test files), jsonl (JSON Lines records), llvm (LLVM MC test files), gas (GNU binutils testsuite files) or gotable (Go test tables)`)
+	flag.IntVar(&args.mode, "mode", 64,
+		`Machine mode to generate tests for: 64 (amd64 test suite) or 32 (386 test suite)`)
+	flag.BoolVar(&args.branches, "branches", false,
+		`Whether to generate tests for rel8/rel32 branch forms (written to the "branch" file)`)
+	flag.StringVar(&args.encoder, "encoder", "xed",
+		`Encoder backend that is used to produce test encodings: xed (Intel XED library), go (pure Go VEX/EVEX encoder) or fixture (replay -fixture file)`)
+	flag.StringVar(&args.fixture, "fixture", "",
+		`Recorded encodings file for -encoder=fixture`)
+	flag.StringVar(&args.record, "record", "",
+		`Where to write encodings fixture that can be replayed with -encoder=fixture; nothing is recorded if empty`)
+	flag.StringVar(&args.llvmSyntax, "llvm-syntax", "att",
+		`Assembly syntax for -format=llvm: att or intel`)
+	flag.StringVar(&args.template, "template", "",
+		`Custom text/template file for -format=asm; built-in template is used if empty`)
+	flag.StringVar(&args.include, "include", "../../../../../../runtime/textflag.h",
+		`textflag.h include path for -format=asm`)
+	flag.StringVar(&args.symbolPrefix, "symbol-prefix", "asmtest_",
+		`TEXT symbol name prefix for -format=asm`)
+	flag.StringVar(&args.split, "split", "",
+		`Split -format=asm output into several TEXT functions: mnemonic or vl; no split if empty`)
+	flag.IntVar(&args.maxLines, "max-lines", 0,
+		`Max number of test lines per TEXT function for -format=asm; no limit if 0`)
+	flag.StringVar(&args.gotablePackage, "gotable-package", "asmtest",
+		`Go package name for -format=gotable output files`)
+	flag.StringVar(&args.verifyGas, "verify-gas", "",
+		`Cross-validate encodings with GNU as: merge (add gas encoding to the "or" list) or flag (report mismatches as failures); disabled if empty`)
+	flag.StringVar(&args.gasPath, "gas", "as",
+		`GNU as executable that is used by -verify-gas`)
+	flag.StringVar(&args.config, "config", "",
+		`JSON file with operand tables (args, peeks, normalize, vmemWidths); built-in tables are used if empty`)
+	flag.StringVar(&args.diff, "diff", "",
+		`Compare generated tests with Go assembler test files from the given dir instead of writing output; exit with error if they differ`)
+	flag.IntVar(&args.jobs, "j", 1,
+		`Number of concurrent encoding workers; output does not depend on it`)
 	flag.BoolVar(&args.debug, "debug", false,
 		`Whether to print extra output that is useful for debugging`)
 	flag.BoolVar(&args.commented, "commented", false,
 		`Whether to output all test lines under TODO comment`)
+	flag.StringVar(&args.failuresJSON, "failures-json", "",
+		`Where to write encoder failures report in JSON format; no report is written if empty`)
+	flag.IntVar(&args.maxFailures, "max-failures", -1,
+		`Exit with error if encoder failures count exceeds this value; negative value means no limit`)
 
 	flag.Parse()
 
 	if args.x86csv == "" {
 		return fmt.Errorf("-x86csv can't be empty")
 	}
+	if outputFormats[args.format] == nil {
+		return fmt.Errorf("unknown -format=%s", args.format)
+	}
+	if encoderBackends[args.encoder] == nil {
+		return fmt.Errorf("unknown -encoder=%s", args.encoder)
+	}
+	switch args.mode {
+	case 64:
+		ctx.mode = x86encode.Mode64
+	case 32:
+		ctx.mode = x86encode.Mode32
+	default:
+		return fmt.Errorf("unknown -mode=%d", args.mode)
+	}
+	if args.jobs < 1 {
+		return fmt.Errorf("-j should be positive, got %d", args.jobs)
+	}
+	if args.llvmSyntax != "att" && args.llvmSyntax != "intel" {
+		return fmt.Errorf("unknown -llvm-syntax=%s", args.llvmSyntax)
+	}
+	switch args.split {
+	case "", "mnemonic", "vl":
+		// OK.
+	default:
+		return fmt.Errorf("unknown -split=%s", args.split)
+	}
+	switch args.verifyGas {
+	case "", "merge", "flag":
+		// OK.
+	default:
+		return fmt.Errorf("unknown -verify-gas=%s", args.verifyGas)
+	}
 
 	ctx.args = &args
+	ctx.generator = &avx512gen.GeneratorInfo{
+		Args:    os.Args[1:],
+		X86CSV:  args.x86csv,
+		Encoder: args.encoder,
+		Flags:   generatorFlags(),
+	}
 
 	return nil
 }
 
 func (ctx *context) init() error {
-	ctx.peeks = map[string]int{}
-	ctx.testLineByAsm = map[string]*testLine{}
+	if ctx.args.encoder == "xed" {
+		ctx.generator.XEDVersion = x86encode.XEDVersion()
+	}
 
 	return nil
 }
 
-func (ctx *context) prepareOutputDir() error {
-	return os.MkdirAll(ctx.args.output, 0775)
-}
-
-func (ctx *context) readCSV() error {
-	f, err := os.Open(ctx.args.x86csv)
-	if err != nil {
-		return fmt.Errorf("open x86csv file: %v", err)
+func (ctx *context) loadConfig() error {
+	if ctx.args.config == "" {
+		ctx.argTable = avx512gen.NewArgTable().ForMode(ctx.mode)
+		return nil
 	}
-	defer f.Close()
 
-	insts, err := x86csv.NewReader(f).ReadAll()
+	data, err := ioutil.ReadFile(ctx.args.config)
 	if err != nil {
-		return fmt.Errorf("decode x86csv: %v", err)
+		return err
 	}
-
-	ctx.insts = insts
-
-	return nil
-}
-
-func (ctx *context) filterInsts() error {
-	insts := ctx.insts[:0]
-
-	skipByGoOpcode := map[string]bool{
-		"VPEXTRW": true,
-		"VMOVQ":   true,
-		"VMOVHPD": true,
-		"VMOVLPD": true,
-	}
-
-	for _, inst := range ctx.insts {
-		switch {
-		case inst.Mode64 != "V":
-			continue // Not valid in 64-bit mode
-		case strings.Contains(inst.IntelOpcode(), "NOP"):
-			continue // Skip all kinds of NO-OPs
-		case !strings.Contains(inst.CPUID, "AVX512"):
-			continue // Not an AVX-512 form/instruction
-		case skipByGoOpcode[inst.GoOpcode()]:
-			continue // Explicitly skipped
-		}
-
-		insts = append(insts, inst)
+	table, err := avx512gen.LoadArgTable(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", ctx.args.config, err)
 	}
-
-	ctx.insts = insts
+	ctx.argTable = table.ForMode(ctx.mode)
 
 	return nil
 }
 
-func (ctx *context) generateTests() error {
-	for _, inst := range ctx.insts {
-		if err := ctx.generateInstTests(inst); err != nil {
-			return fmt.Errorf("generate tests: %s: %v", inst.Go, err)
-		}
+func (ctx *context) prepareOutputDir() error {
+	if ctx.args.diff != "" {
+		return nil
 	}
-
-	return nil
+	return os.MkdirAll(ctx.args.output, 0775)
 }
 
-func (ctx *context) writeOutput() error {
-	testsByCPUID := map[string][]*testLine{}
-
-	for _, test := range ctx.testLineByAsm {
-		testsByCPUID[test.cpuid] = append(testsByCPUID[test.cpuid], test)
-	}
-
-	// We need *some* sorting to avoid unwanted diffs between program runs.
-	for _, tests := range testsByCPUID {
-		sort.SliceStable(tests, func(i, j int) bool {
-			return tests[i].Asm < tests[j].Asm
-		})
-	}
-
-	cpuid2filename := map[string]string{
-		"AES":              "aes_avx512f",
-		"GFNI":             "gfni_avx512f",
-		"VPCLMULQDQ":       "vpclmulqdq_avx512f",
-		"AVX512BW":         "avx512bw",
-		"AVX512CD":         "avx512cd",
-		"AVX512DQ":         "avx512dq",
-		"AVX512ER":         "avx512er",
-		"AVX512F":          "avx512f",
-		"AVX512PF":         "avx512pf",
-		"AVX512_4FMAPS":    "avx512_4fmaps",
-		"AVX512_4VNNIW":    "avx512_4vnniw",
-		"AVX512_BITALG":    "avx512_bitalg",
-		"AVX512_IFMA":      "avx512_ifma",
-		"AVX512_VBMI":      "avx512_vbmi",
-		"AVX512_VBMI2":     "avx512_vbmi2",
-		"AVX512_VNNI":      "avx512_vnni",
-		"AVX512_VPOPCNTDQ": "avx512_vpopcntdq",
+func (ctx *context) readCSV() error {
+	data, err := ioutil.ReadFile(ctx.args.x86csv)
+	if err != nil {
+		return fmt.Errorf("open x86csv file: %v", err)
 	}
 
-	testFileTemplate := template.Must(template.New("asmtest").Parse(`// Code generated by avx512test. DO NOT EDIT.
-
-#include "../../../../../../runtime/textflag.h"
-
-TEXT asmtest_{{.Name}}(SB), NOSPLIT, $0
-{{ range .Tests }}
-  {{- if $.Commented }}
-    {{- printf "\t//TODO: %-50s // %s\n" .Asm .Enc }}
-  {{- else }}
-    {{- printf "\t%-50s // %s\n" .Asm .Enc }}
-  {{- end }}
-{{- end }}
-{{- printf "\tRET" }}
-`))
-
-	for cpuid, tests := range testsByCPUID {
-		filename := cpuid2filename[cpuid]
-
-		var tdata struct {
-			Commented bool
-			Name      string
-			Tests     []*testLine
-		}
-		tdata.Commented = ctx.args.commented
-		tdata.Name = filename
-		tdata.Tests = tests
-
-		var buf bytes.Buffer
-		if err := testFileTemplate.Execute(&buf, tdata); err != nil {
-			return fmt.Errorf("%s tests: %v", cpuid, err)
-		}
-		outFilename := filepath.Join(ctx.args.output, filename+".s")
-		if err := ioutil.WriteFile(outFilename, buf.Bytes(), 0644); err != nil {
-			return fmt.Errorf("%s tests: %v", cpuid, err)
-		}
-	}
+	ctx.source = &avx512gen.CSVSource{Data: data}
+	ctx.generator.X86CSVVersion = ctx.source.Version()
+	ctx.generator.X86CSVHash = ctx.source.Hash()
 
 	return nil
 }
 
-func (ctx *context) generateInstTests(inst *x86csv.Inst) error {
-	var argLists [][]instArg
-	for _, arg := range inst.IntelArgs() {
-		argLists = append(argLists, ctx.parseArg(inst, arg))
-	}
-	argLists = argsCartesianProd(argLists)
-
-	for _, argList := range argLists {
-		asm := goAsmString(inst, argList)
-
-		var encodings []string
-		for _, rexw := range instREXW(inst) {
-			for _, vl := range instVL(inst) {
-				params := []x86encode.InstParam{rexw, vl}
-				enc, err := ctx.encodeInst(inst, argList, params)
-				if err != nil {
-					log.Printf("%q <%s,%s>: encoder error: %v",
-						asm, rexw, vl, err)
-					continue
-				}
-				if enc == "" {
-					log.Printf("%q <%s,%s>: empty encoding string",
-						asm, rexw, vl)
-					continue
-				}
-				if !strings.HasPrefix(enc, "62") && evexEncoded(inst) {
-					ctx.debugf("%q <%s,%s>: skip non-evex (enc=%q)\n",
-						asm, rexw, vl, enc)
-					continue
-				}
-				encodings = append(encodings, enc)
-			}
-		}
-
-		if len(encodings) == 0 {
-			ctx.debugf("%q: empty test set", asm)
-			continue
-		}
-
-		test := ctx.testLineByAsm[asm]
-		if test != nil {
-			ctx.debugf("%q: skip duplicate (%s)", asm, test.Enc)
-			continue
-		}
-
-		ctx.testLineByAsm[asm] = &testLine{
-			Asm:   asm,
-			Enc:   strings.Join(encodings, " or "),
-			cpuid: normalizeCPUID(inst.CPUID),
-		}
+func (ctx *context) generateTests() error {
+	tests, err := avx512gen.Generate(&avx512gen.Config{
+		Source:    ctx.source,
+		Mode:      ctx.mode,
+		Branches:  ctx.args.branches,
+		Args:      ctx.argTable,
+		Encoder:   ctx.encoder,
+		Jobs:      ctx.args.jobs,
+		OnFailure: ctx.addFailure,
+		Debugf:    ctx.debugf,
+	})
+	if err != nil {
+		return err
 	}
+	ctx.tests = tests
 
 	return nil
 }
 
-func (ctx *context) encodeInst(inst *x86csv.Inst, argList []instArg, params []x86encode.InstParam) (string, error) {
-	switch inst.DataSize {
-	case "8":
-		params = append(params, x86encode.ParamEOSZ8)
-	case "16":
-		params = append(params, x86encode.ParamEOSZ16)
-	case "32":
-		params = append(params, x86encode.ParamEOSZ32)
-	case "64":
-		params = append(params, x86encode.ParamEOSZ64)
+func (ctx *context) verifyGas() error {
+	var mode avx512gen.GasMode
+	switch ctx.args.verifyGas {
+	case "":
+		return nil
+	case "merge":
+		mode = avx512gen.GasMerge
+	case "flag":
+		mode = avx512gen.GasFlag
 	}
 
-	args := make([]x86encode.Argument, len(argList))
-	for i := range argList {
-		if mem, ok := argList[i].data.(*x86encode.MemArgument); ok {
-			// For AVX512 special handling of displacement is required.
-			// Copy of mem is required as it's shared among several args
-			// and we're about to modify it.
-			copied := *mem
-			if strings.Contains(inst.Tags, "scale") && !inst.HasTag("scale1") {
-				if copied.Disp != 0 {
-					copied.DispWidth = x86encode.Disp32
-				}
-			}
-			argList[i].data = &copied
-		}
-		args[i] = argList[i].data
+	cfg := &avx512gen.Config{
+		Mode:      ctx.mode,
+		OnFailure: ctx.addFailure,
+		Debugf:    ctx.debugf,
 	}
-
-	return x86encode.ToHexString(&x86encode.Inst{
-		Opcode: inst.IntelOpcode(),
-		Params: params,
-		Args:   args,
-	})
+	return avx512gen.VerifyWithGas(cfg, ctx.tests, ctx.args.gasPath, mode)
 }
 
-func (ctx *context) parseArg(inst *x86csv.Inst, arg string) []instArg {
-	arg = normalizeArg(inst, arg)
-
-	if arglist := instArgsBySyntax[arg]; arglist != nil {
-		npeeks, ok := peeksPerArgBySyntax[arg]
-		if !ok {
-			panic(fmt.Sprintf("undefined npeeks for %q", arg))
-		}
-
-		ret := make([]instArg, npeeks)
-		i := ctx.peeks[arg]
-		for j := 0; j < npeeks; j++ {
-			ret[j] = arglist[i]
-			i++
-			if i >= len(arglist) {
-				i = 0
-			}
-		}
-		ctx.peeks[arg] = i
-
-		return ret
-	}
-
-	switch arg {
-	case "{k}{z}", "{k1-k7}":
-		// Ignore zeroing.
-		return ctx.parseArg(inst, "{k}")
-	case "r/m32":
-		return ctx.parseArgs(inst, "rmr32", "m32")
-	case "r/m64":
-		return ctx.parseArgs(inst, "rmr64", "m64")
-	default:
-		if strings.Contains(arg, "/m") {
-			return ctx.parseArgs(inst, strings.Split(arg, "/")...)
-		}
-		panic(fmt.Sprintf("unhandled %q arg", arg))
-	}
-}
-
-func (ctx *context) parseArgs(inst *x86csv.Inst, args ...string) []instArg {
-	var parsed []instArg
-	for _, arg := range args {
-		parsed = append(parsed, ctx.parseArg(inst, arg)...)
-	}
-	return parsed
+func (ctx *context) addFailure(f *avx512gen.Failure) {
+	ctx.failures = append(ctx.failures, f)
 }
 
 func (ctx *context) debugf(format string, args ...interface{}) {
 	if ctx.args.debug {
 		log.Printf("debug: "+format, args...)
 	}
-
 }
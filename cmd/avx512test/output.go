@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+
+	"github.com/quasilyte/avx512test/avx512gen"
+)
+
+// outputFormats maps -format flag value to the associated writer constructor.
+var outputFormats = map[string]func(ctx *context) avx512gen.Writer{
+	"asm": func(ctx *context) avx512gen.Writer {
+		return &avx512gen.AsmWriter{
+			Template:     ctx.asmTemplate,
+			Include:      ctx.args.include,
+			SymbolPrefix: ctx.args.symbolPrefix,
+			Split:        ctx.args.split,
+			MaxLines:     ctx.args.maxLines,
+			Commented:    ctx.args.commented,
+			Generator:    ctx.generator,
+		}
+	},
+	"jsonl": func(ctx *context) avx512gen.Writer {
+		return &avx512gen.JSONLWriter{Generator: ctx.generator}
+	},
+	"llvm": func(ctx *context) avx512gen.Writer {
+		return &avx512gen.LLVMWriter{
+			Syntax:    ctx.args.llvmSyntax,
+			Mode:      ctx.mode,
+			Generator: ctx.generator,
+		}
+	},
+	"gas": func(ctx *context) avx512gen.Writer {
+		return &avx512gen.GasWriter{Mode: ctx.mode, Generator: ctx.generator}
+	},
+	"gotable": func(ctx *context) avx512gen.Writer {
+		return &avx512gen.GoTableWriter{
+			Package:   ctx.args.gotablePackage,
+			Generator: ctx.generator,
+		}
+	},
+}
+
+func (ctx *context) loadAsmTemplate() error {
+	text := avx512gen.AsmTemplate
+	if ctx.args.template != "" {
+		data, err := ioutil.ReadFile(ctx.args.template)
+		if err != nil {
+			return err
+		}
+		text = string(data)
+	}
+	tmpl, err := avx512gen.ParseAsmTemplate(text)
+	if err != nil {
+		return err
+	}
+	ctx.asmTemplate = tmpl
+	return nil
+}
+
+func (ctx *context) writeOutput() error {
+	if ctx.args.diff != "" {
+		return nil // Diff mode does not write any files
+	}
+
+	testsByFilename := avx512gen.GroupByFilename(ctx.tests)
+	filenames := make([]string, 0, len(testsByFilename))
+	for filename := range testsByFilename {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	w := outputFormats[ctx.args.format](ctx)
+	for _, filename := range filenames {
+		tests := testsByFilename[filename]
+		files, err := w.WriteTests(filename, tests)
+		if err != nil {
+			return fmt.Errorf("%s tests: %v", tests[0].CPUID, err)
+		}
+		if err := ctx.writeOutputFiles(files...); err != nil {
+			return err
+		}
+	}
+
+	if w, ok := w.(*avx512gen.AsmWriter); ok {
+		if index := w.Index(); index != nil {
+			return ctx.writeOutputFiles(index)
+		}
+	}
+
+	return nil
+}
+
+func (ctx *context) writeOutputFiles(files ...*avx512gen.File) error {
+	for _, f := range files {
+		filename := filepath.Join(ctx.args.output, f.Name)
+		if err := ctx.writeOutputFile(filename, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
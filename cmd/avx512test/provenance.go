@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/quasilyte/avx512test/avx512gen"
+)
+
+// localFlags do not affect generated output contents.
+// They're excluded from the provenance header.
+var localFlags = map[string]bool{
+	"x86csv":        true,
+	"output":        true,
+	"debug":         true,
+	"failures-json": true,
+	"max-failures":  true,
+	"gas":           true,
+	"fixture":       true,
+	"record":        true,
+	"j":             true,
+}
+
+// generatorFlags returns explicitly set flags that affect the output.
+func generatorFlags() []string {
+	var flags []string
+	flag.Visit(func(f *flag.Flag) {
+		if !localFlags[f.Name] {
+			flags = append(flags, fmt.Sprintf("-%s=%s", f.Name, f.Value))
+		}
+	})
+	return flags
+}
+
+// writeOutputFile writes generated file contents.
+//
+// If f has a provenance header, the header of the existing file
+// (if any) is compared with the current one and a warning is printed
+// for every mismatching key.
+func (ctx *context) writeOutputFile(filename string, f *avx512gen.File) error {
+	if f.HasProvenance() {
+		ctx.checkProvenance(filename, f)
+	}
+	return ioutil.WriteFile(filename, f.Data, 0644)
+}
+
+func (ctx *context) checkProvenance(filename string, f *avx512gen.File) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return // Nothing to compare with
+	}
+	old := f.ParseProvenance(data)
+
+	seen := map[string]bool{}
+	for _, line := range ctx.generator.Provenance() {
+		parts := strings.SplitN(line, ": ", 2)
+		key, value := parts[0], parts[1]
+		seen[key] = true
+		oldValue, ok := old[key]
+		switch {
+		case !ok:
+			log.Printf("warning: %s: no %q in provenance header", filename, key)
+		case oldValue != value:
+			log.Printf("warning: %s: %s changed: was %q, now %q",
+				filename, key, oldValue, value)
+		}
+	}
+
+	var removed []string
+	for key := range old {
+		if !seen[key] {
+			removed = append(removed, key)
+		}
+	}
+	sort.Strings(removed)
+	for _, key := range removed {
+		log.Printf("warning: %s: %s removed: was %q", filename, key, old[key])
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/quasilyte/avx512test/avx512gen"
+)
+
+func TestCheckProvenance(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "avx512f.s")
+	old := strings.Join([]string{
+		"// Code generated by avx512test. DO NOT EDIT.",
+		"// encoder: xed",
+		"// xed: v11.0",
+		"// x86.csv: v0.2x",
+		"// flags: -encoder=xed",
+		"",
+		"// x86.csv: not a header line",
+	}, "\n")
+	if err := ioutil.WriteFile(filename, []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	output, flags := log.Writer(), log.Flags()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(output)
+		log.SetFlags(flags)
+	}()
+
+	ctx := &context{generator: &avx512gen.GeneratorInfo{
+		Encoder:       "go",
+		X86CSVVersion: "v0.2x",
+		X86CSVHash:    "abc",
+		Flags:         []string{"-encoder=go"},
+	}}
+	ctx.checkProvenance(filename, &avx512gen.File{Comment: "//"})
+
+	want := strings.Join([]string{
+		`warning: ` + filename + `: encoder changed: was "xed", now "go"`,
+		`warning: ` + filename + `: no "x86.csv sha256" in provenance header`,
+		`warning: ` + filename + `: flags changed: was "-encoder=xed", now "-encoder=go"`,
+		`warning: ` + filename + `: xed removed: was "v11.0"`,
+		``,
+	}, "\n")
+	if have := buf.String(); have != want {
+		t.Errorf("warnings mismatch:\nhave:\n%s\nwant:\n%s", have, want)
+	}
+}
@@ -0,0 +1,164 @@
+package x86encode
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Encoder encodes instructions into machine code.
+//
+// Please note that sometimes there are more than one way to
+// encode the same instruction, so different encoders
+// may produce different results for the same inst.
+//
+// All encoders from this package are safe for concurrent use
+// (RecordingEncoder as long as the wrapped encoder is).
+type Encoder interface {
+	Encode(inst *Inst) ([]byte, error)
+}
+
+// Describer is implemented by encoders that can report
+// details about the encoded instruction.
+type Describer interface {
+	// Describe returns encoding details for the code
+	// that was produced by Encode.
+	Describe(code []byte) (*Encoding, error)
+}
+
+// BatchEncoder is implemented by encoders that can encode
+// several instructions at once more efficiently.
+type BatchEncoder interface {
+	// EncodeBatch encodes every inst from insts.
+	// Results are index-aligned with insts: for every i,
+	// either codes[i] or errs[i] is set.
+	EncodeBatch(insts []*Inst) (codes [][]byte, errs []error)
+}
+
+// BatchDescriber is implemented by encoders that can encode
+// and describe several instructions at once.
+type BatchDescriber interface {
+	// EncodeDescribeBatch is like EncodeBatch followed by Describe
+	// for every encoded instruction. Results are index-aligned with insts.
+	// Empty codes are not described: they're reported as Encoding with empty Hex.
+	EncodeDescribeBatch(insts []*Inst) (encs []*Encoding, errs []error)
+}
+
+// MachineMode is a CPU operating mode.
+type MachineMode int
+
+const (
+	Mode64 MachineMode = iota // 64-bit (long) mode
+	Mode32                    // 32-bit protected mode
+	Mode16                    // 16-bit protected mode
+)
+
+// Options describe XEDEncoder configuration.
+// Zero value describes 64-bit mode encoder.
+type Options struct {
+	// Mode is a machine mode instructions are encoded for.
+	Mode MachineMode
+
+	// AddressWidth is a stack address width in bits: 16, 32 or 64.
+	// Zero value means the natural width for Mode.
+	// Only 64 is valid for Mode64.
+	AddressWidth int
+}
+
+func (opts *Options) validate() error {
+	switch opts.Mode {
+	case Mode64:
+		if opts.AddressWidth != 0 && opts.AddressWidth != 64 {
+			return fmt.Errorf("bad address width for 64-bit mode: %d", opts.AddressWidth)
+		}
+	case Mode32, Mode16:
+		if opts.AddressWidth != 0 && opts.AddressWidth != 16 && opts.AddressWidth != 32 {
+			return fmt.Errorf("bad address width for %d-bit mode: %d", opts.Mode.Bits(), opts.AddressWidth)
+		}
+	default:
+		return fmt.Errorf("unknown machine mode: %d", int(opts.Mode))
+	}
+	return nil
+}
+
+func (opts *Options) addressWidth() int {
+	if opts.AddressWidth != 0 {
+		return opts.AddressWidth
+	}
+	return opts.Mode.Bits()
+}
+
+// Bits returns mode word size in bits.
+func (mode MachineMode) Bits() int {
+	switch mode {
+	case Mode32:
+		return 32
+	case Mode16:
+		return 16
+	default:
+		return 64
+	}
+}
+
+// XEDEncoder is an Encoder that uses Intel XED library.
+//
+// Every XEDEncoder holds its own XED state that is initialized
+// once, on the first use. After that, XED is only used for reading,
+// so XEDEncoder can be used from several goroutines.
+//
+// Zero value is a 64-bit mode encoder. Use New to create
+// encoders for other modes. XEDEncoder should not be copied.
+type XEDEncoder struct {
+	opts Options
+
+	once    sync.Once
+	machine *xedMachine
+}
+
+// New returns XEDEncoder that is configured by opts.
+func New(opts Options) (*XEDEncoder, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	return &XEDEncoder{opts: opts}, nil
+}
+
+// Options returns encoder configuration.
+func (enc *XEDEncoder) Options() Options { return enc.opts }
+
+func (enc *XEDEncoder) init() *xedMachine {
+	enc.once.Do(func() {
+		enc.machine = newXEDMachine(&enc.opts)
+	})
+	return enc.machine
+}
+
+// Encode implements Encoder interface.
+func (enc *XEDEncoder) Encode(inst *Inst) ([]byte, error) {
+	return enc.init().encode(inst)
+}
+
+// EncodeBatch implements BatchEncoder interface.
+//
+// It's like calling Encode for every inst, but all instructions
+// are encoded by XED in a single cgo call.
+func (enc *XEDEncoder) EncodeBatch(insts []*Inst) ([][]byte, []error) {
+	return enc.init().encodeBatch(insts)
+}
+
+// EncodeDescribeBatch implements BatchDescriber interface.
+//
+// Instructions are encoded and decoded back by XED in a single cgo call.
+func (enc *XEDEncoder) EncodeDescribeBatch(insts []*Inst) ([]*Encoding, []error) {
+	return enc.init().encodeDescribeBatch(insts)
+}
+
+// Describe implements Describer interface.
+func (enc *XEDEncoder) Describe(code []byte) (*Encoding, error) {
+	return enc.init().describe(code)
+}
+
+// Disassemble returns textual representation of the encoded instruction
+// in requested syntax. Code is expected to contain exactly one instruction.
+func (enc *XEDEncoder) Disassemble(code []byte, syntax Syntax) (string, error) {
+	return enc.init().disassemble(code, syntax)
+}
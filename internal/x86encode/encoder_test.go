@@ -0,0 +1,37 @@
+package x86encode
+
+import (
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	goodOptions := []Options{
+		{},
+		{Mode: Mode64, AddressWidth: 64},
+		{Mode: Mode32},
+		{Mode: Mode32, AddressWidth: 16},
+		{Mode: Mode16, AddressWidth: 32},
+	}
+	for _, opts := range goodOptions {
+		enc, err := New(opts)
+		if err != nil {
+			t.Errorf("New(%+v): %v", opts, err)
+			continue
+		}
+		if enc.Options() != opts {
+			t.Errorf("New(%+v): options mismatch: %+v", opts, enc.Options())
+		}
+	}
+
+	badOptions := []Options{
+		{Mode: Mode64, AddressWidth: 32},
+		{Mode: Mode32, AddressWidth: 64},
+		{Mode: Mode16, AddressWidth: 8},
+		{Mode: MachineMode(10)},
+	}
+	for _, opts := range badOptions {
+		if _, err := New(opts); err == nil {
+			t.Errorf("New(%+v): expected error", opts)
+		}
+	}
+}
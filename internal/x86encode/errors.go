@@ -0,0 +1,49 @@
+package x86encode
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrUnknownOpcode is returned when Inst.Opcode is not recognized by the encoder.
+var ErrUnknownOpcode = errors.New("unknown opcode")
+
+// ErrUnknownRegister is returned when register name is not recognized by the encoder.
+type ErrUnknownRegister struct {
+	Name string
+}
+
+func (e *ErrUnknownRegister) Error() string {
+	return fmt.Sprintf("unknown register %q", e.Name)
+}
+
+// ErrBadOperand is returned when Inst.Args[Index] can't be converted
+// to the encoder operand. Err describes the exact reason.
+type ErrBadOperand struct {
+	Index int
+	Err   error
+}
+
+func (e *ErrBadOperand) Error() string {
+	return fmt.Sprintf("error in Args[%d]: %v", e.Index, e.Err)
+}
+
+func (e *ErrBadOperand) Unwrap() error { return e.Err }
+
+// ErrXED is returned when XED rejects the instruction.
+// Usually means that requested instruction form is not encodable.
+type ErrXED struct {
+	// Code is a xed_error_enum_t value.
+	Code int
+
+	// Name is a Code string representation, like "GENERAL_ERROR".
+	Name string
+}
+
+func (e *ErrXED) Error() string {
+	return "xed error: " + e.Name
+}
+
+// ErrUnencodable is returned when none of the known instruction
+// forms can encode the given operands.
+var ErrUnencodable = errors.New("no matching instruction form")
@@ -0,0 +1,367 @@
+package x86encode
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrNotRecorded is returned by FixtureEncoder for instructions
+// that are missing from the fixture.
+var ErrNotRecorded = errors.New("instruction is not recorded")
+
+// Fixture is a set of recorded encoder results, keyed by InstKey.
+//
+// Fixtures are stored as JSON Lines: a header that records the machine
+// mode (and XED version, if known), followed by one record per instruction, sorted by key,
+// so they can be checked in and diffed.
+//
+// Encodings are mode-specific, so a fixture should only be
+// replayed for the mode it was recorded for (see Mode).
+//
+// Fixture is safe for concurrent use.
+type Fixture struct {
+	mode       MachineMode
+	xedVersion string
+
+	mu      sync.Mutex
+	records map[string]*fixtureRecord
+}
+
+// fixtureHeader is the first line of the fixture file.
+type fixtureHeader struct {
+	// Mode is a machine mode word size in bits.
+	Mode int `json:"mode"`
+
+	// XED is a version of the XED library the fixture was recorded with.
+	XED string `json:"xed,omitempty"`
+}
+
+// fixtureRecord is a single recorded Encode result.
+// Exactly one of Hex and Error is set.
+type fixtureRecord struct {
+	Key string `json:"key"`
+
+	Hex            string `json:"hex,omitempty"`
+	Iform          string `json:"iform,omitempty"`
+	TupleType      string `json:"tupleType,omitempty"`
+	DispScale      int    `json:"dispScale,omitempty"`
+	DispCompressed bool   `json:"dispCompressed,omitempty"`
+
+	Error string `json:"error,omitempty"`
+
+	// XEDCode is set for ErrXED errors, so they
+	// can be replayed with the same type.
+	XEDCode int `json:"xedCode,omitempty"`
+}
+
+// NewFixture returns empty fixture for instructions
+// that are encoded for the given machine mode.
+func NewFixture(mode MachineMode) *Fixture {
+	return &Fixture{mode: mode, records: map[string]*fixtureRecord{}}
+}
+
+// LoadFixture reads fixture that was written by Fixture.WriteTo.
+func LoadFixture(r io.Reader) (*Fixture, error) {
+	var f *Fixture
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		if f == nil {
+			var err error
+			f, err = decodeFixtureHeader(scanner.Bytes())
+			if err != nil {
+				return nil, fmt.Errorf("line %d: bad header: %v", line, err)
+			}
+			continue
+		}
+		var rec fixtureRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if rec.Key == "" {
+			return nil, fmt.Errorf("line %d: empty key", line)
+		}
+		if (rec.Hex == "") == (rec.Error == "") {
+			return nil, fmt.Errorf("line %d: exactly one of hex and error should be set", line)
+		}
+		f.records[rec.Key] = &rec
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if f == nil {
+		return nil, errors.New("missing header")
+	}
+	return f, nil
+}
+
+// decodeFixtureHeader returns empty fixture that is described by the header.
+func decodeFixtureHeader(data []byte) (*Fixture, error) {
+	var header fixtureHeader
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&header); err != nil {
+		return nil, err
+	}
+	var mode MachineMode
+	switch header.Mode {
+	case 64:
+		mode = Mode64
+	case 32:
+		mode = Mode32
+	case 16:
+		mode = Mode16
+	default:
+		return nil, fmt.Errorf("unknown %d-bit mode", header.Mode)
+	}
+	f := NewFixture(mode)
+	f.xedVersion = header.XED
+	return f, nil
+}
+
+// Mode returns machine mode the fixture was recorded for.
+func (f *Fixture) Mode() MachineMode { return f.mode }
+
+// XEDVersion returns version of the XED library the fixture
+// was recorded with. Empty if encodings were not produced by XED.
+func (f *Fixture) XEDVersion() string { return f.xedVersion }
+
+// SetXEDVersion records the version of the XED library
+// that produced fixture encodings.
+func (f *Fixture) SetXEDVersion(version string) { f.xedVersion = version }
+
+// Len returns the number of recorded instructions.
+func (f *Fixture) Len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.records)
+}
+
+func (f *Fixture) lookup(key string) *fixtureRecord {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.records[key]
+}
+
+func (f *Fixture) add(rec *fixtureRecord) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.records[rec.Key] = rec
+}
+
+// WriteTo writes fixture records to w.
+func (f *Fixture) WriteTo(w io.Writer) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	keys := make([]string, 0, len(f.records))
+	for key := range f.records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	cw := &countingWriter{w: w}
+	enc := json.NewEncoder(cw)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(fixtureHeader{Mode: f.mode.Bits(), XED: f.xedVersion}); err != nil {
+		return cw.n, err
+	}
+	for _, key := range keys {
+		if err := enc.Encode(f.records[key]); err != nil {
+			return cw.n, err
+		}
+	}
+	return cw.n, nil
+}
+
+// RecordingEncoder is an Encoder that forwards instructions to
+// the wrapped Encoder and records the results into Fixture.
+//
+// Encoding details are recorded too if Encoder implements Describer.
+//
+// RecordingEncoder is safe for concurrent use if Encoder is.
+type RecordingEncoder struct {
+	Encoder Encoder
+	Fixture *Fixture
+}
+
+// Encode implements Encoder interface.
+func (enc *RecordingEncoder) Encode(inst *Inst) ([]byte, error) {
+	code, err := enc.Encoder.Encode(inst)
+	rec := &fixtureRecord{Key: InstKey(inst)}
+	switch {
+	case err != nil:
+		rec.Error = err.Error()
+		var xedErr *ErrXED
+		if errors.As(err, &xedErr) {
+			rec.Error = xedErr.Name
+			rec.XEDCode = xedErr.Code
+		}
+	case len(code) == 0:
+		// Nothing to replay.
+		return code, err
+	default:
+		rec.Hex = fmt.Sprintf("%x", code)
+		if describer, ok := enc.Encoder.(Describer); ok {
+			desc, err := describer.Describe(code)
+			if err != nil {
+				return nil, err
+			}
+			rec.Iform = desc.Iform
+			rec.TupleType = desc.TupleType
+			rec.DispScale = desc.DispScale
+			rec.DispCompressed = desc.DispCompressed
+		}
+	}
+	enc.Fixture.add(rec)
+	return code, err
+}
+
+// Describe implements Describer interface.
+// Returns only Hex if the wrapped Encoder is not a Describer.
+func (enc *RecordingEncoder) Describe(code []byte) (*Encoding, error) {
+	if describer, ok := enc.Encoder.(Describer); ok {
+		return describer.Describe(code)
+	}
+	return &Encoding{Hex: fmt.Sprintf("%x", code)}, nil
+}
+
+// FixtureEncoder is an Encoder that replays results recorded by
+// RecordingEncoder. It does not need XED, so it can be used
+// to run encoder-dependent code with cgo disabled.
+//
+// FixtureEncoder encodes for Fixture.Mode(); callers should
+// check that it's the mode they expect.
+type FixtureEncoder struct {
+	Fixture *Fixture
+
+	descOnce  sync.Once
+	descByHex map[string]*Encoding
+}
+
+// Encode implements Encoder interface.
+//
+// Recorded XED failures are returned as ErrXED, other recorded
+// failures are returned as plain errors with the same text.
+// ErrNotRecorded is returned for unknown instructions.
+func (enc *FixtureEncoder) Encode(inst *Inst) ([]byte, error) {
+	key := InstKey(inst)
+	rec := enc.Fixture.lookup(key)
+	switch {
+	case rec == nil:
+		return nil, fmt.Errorf("%w: %s", ErrNotRecorded, key)
+	case rec.XEDCode != 0:
+		return nil, &ErrXED{Code: rec.XEDCode, Name: rec.Error}
+	case rec.Error != "":
+		return nil, errors.New(rec.Error)
+	default:
+		return hex.DecodeString(rec.Hex)
+	}
+}
+
+// Describe implements Describer interface.
+func (enc *FixtureEncoder) Describe(code []byte) (*Encoding, error) {
+	enc.descOnce.Do(func() {
+		enc.Fixture.mu.Lock()
+		defer enc.Fixture.mu.Unlock()
+		enc.descByHex = map[string]*Encoding{}
+		for _, rec := range enc.Fixture.records {
+			if rec.Hex == "" {
+				continue
+			}
+			enc.descByHex[rec.Hex] = &Encoding{
+				Hex:            rec.Hex,
+				Iform:          rec.Iform,
+				TupleType:      rec.TupleType,
+				DispScale:      rec.DispScale,
+				DispCompressed: rec.DispCompressed,
+			}
+		}
+	})
+	hexCode := fmt.Sprintf("%x", code)
+	desc := enc.descByHex[hexCode]
+	if desc == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotRecorded, hexCode)
+	}
+	result := *desc
+	return &result, nil
+}
+
+// InstKey returns a string that uniquely identifies inst.
+// Two instructions have the same key if they have the same
+// opcode, params and arguments.
+//
+// Key format is human-readable, but it's not stable across
+// package versions; re-record fixtures after the update.
+func InstKey(inst *Inst) string {
+	var buf strings.Builder
+	buf.WriteString(inst.Opcode)
+	buf.WriteString(" {")
+	for i, param := range inst.Params {
+		if i != 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(strings.TrimPrefix(param.String(), "Param"))
+	}
+	buf.WriteByte('}')
+	for i, arg := range inst.Args {
+		if i == 0 {
+			buf.WriteByte(' ')
+		} else {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(argumentKey(arg))
+	}
+	return buf.String()
+}
+
+func argumentKey(arg Argument) string {
+	switch arg := arg.(type) {
+	case *RegArgument:
+		return arg.Name
+	case *ImmArgument:
+		suffix := ""
+		if arg.Unsigned {
+			suffix = "u"
+		}
+		return fmt.Sprintf("imm%d%s:%#x", arg.Width, suffix, arg.Value)
+	case *MemArgument:
+		key := fmt.Sprintf("m%d[%s+%s*%d%+d]", arg.Width, arg.Base, arg.Index, arg.Scale, arg.Disp)
+		switch arg.DispWidth {
+		case Disp8:
+			key += ":disp8"
+		case Disp32:
+			key += ":disp32"
+		}
+		return key
+	case *RelArgument:
+		return fmt.Sprintf("rel%d:%+d", arg.Width, arg.Offset)
+	case *PtrArgument:
+		return fmt.Sprintf("ptr16:%d:%#x:%#x", arg.Width, arg.Selector, arg.Offset)
+	default:
+		return fmt.Sprintf("%T", arg)
+	}
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
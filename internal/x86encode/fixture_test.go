@@ -0,0 +1,200 @@
+package x86encode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// stubEncoder encodes every instruction as its opcode bytes
+// and rejects instructions without arguments.
+type stubEncoder struct{}
+
+func (stubEncoder) Encode(inst *Inst) ([]byte, error) {
+	if len(inst.Args) == 0 {
+		return nil, &ErrXED{Code: 1, Name: "GENERAL_ERROR"}
+	}
+	return []byte(inst.Opcode), nil
+}
+
+func (stubEncoder) Describe(code []byte) (*Encoding, error) {
+	return &Encoding{Hex: fmt.Sprintf("%x", code), Iform: string(code) + "_IFORM"}, nil
+}
+
+func TestInstKey(t *testing.T) {
+	inst := &Inst{
+		Opcode: "VADDPD",
+		Params: []InstParam{ParamRexW1, ParamVexL512, ParamBroadcast},
+		Args: []Argument{
+			&RegArgument{Name: "ZMM0"},
+			&RegArgument{Name: "K3"},
+			&MemArgument{Base: "RAX", Index: "RCX", Scale: 2, Width: 64, Disp: -8, DispWidth: Disp8},
+			&ImmArgument{Width: 8, Value: 255, Unsigned: true},
+		},
+	}
+	want := "VADDPD {RexW1,VexL512,Broadcast} ZMM0, K3, m64[RAX+RCX*2-8]:disp8, imm8u:0xff"
+	if have := InstKey(inst); have != want {
+		t.Errorf("key mismatch:\nhave: %q\nwant: %q", have, want)
+	}
+	branch := &Inst{
+		Opcode: "JMP_FAR",
+		Args: []Argument{
+			&PtrArgument{Width: 32, Selector: 0x10, Offset: 0x20},
+			&RelArgument{Width: 8, Offset: -2, Label: "ignored"},
+		},
+	}
+	want = "JMP_FAR {} ptr16:32:0x10:0x20, rel8:-2"
+	if have := InstKey(branch); have != want {
+		t.Errorf("key mismatch:\nhave: %q\nwant: %q", have, want)
+	}
+	if have := InstKey(&Inst{Opcode: "NOP"}); have != "NOP {}" {
+		t.Errorf("key mismatch:\nhave: %q\nwant: %q", have, "NOP {}")
+	}
+}
+
+func TestFixtureEncoder(t *testing.T) {
+	insts := []*Inst{
+		{Opcode: "ADD", Args: []Argument{&RegArgument{Name: "EAX"}}},
+		{Opcode: "SUB", Args: []Argument{&RegArgument{Name: "EAX"}}},
+		{Opcode: "BAD"},
+	}
+
+	recorder := &RecordingEncoder{Encoder: stubEncoder{}, Fixture: NewFixture(Mode64)}
+	for _, inst := range insts {
+		recorder.Encode(inst)
+	}
+	var buf bytes.Buffer
+	if _, err := recorder.Fixture.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	fixture, err := LoadFixture(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fixture.Len() != len(insts) {
+		t.Fatalf("loaded %d records, want %d", fixture.Len(), len(insts))
+	}
+	if fixture.Mode() != Mode64 {
+		t.Errorf("loaded fixture mode: have %d-bit, want 64-bit", fixture.Mode().Bits())
+	}
+
+	if fixture.XEDVersion() != "" {
+		t.Errorf("unexpected XED version: %q", fixture.XEDVersion())
+	}
+
+	buf.Reset()
+	f32 := NewFixture(Mode32)
+	f32.SetXEDVersion("v12.0")
+	if _, err := f32.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), `{"mode":32,"xed":"v12.0"}`+"\n") {
+		t.Errorf("unexpected 32-bit fixture header: %q", buf.String())
+	}
+	f32, err = LoadFixture(&buf)
+	if err != nil || f32.Mode() != Mode32 || f32.XEDVersion() != "v12.0" {
+		t.Errorf("32-bit fixture round trip failed: %v", err)
+	}
+
+	replay := &FixtureEncoder{Fixture: fixture}
+	for _, inst := range insts {
+		wantCode, wantErr := stubEncoder{}.Encode(inst)
+		code, err := replay.Encode(inst)
+		if fmt.Sprint(err) != fmt.Sprint(wantErr) {
+			t.Errorf("%s: error mismatch:\nhave: %v\nwant: %v", inst.Opcode, err, wantErr)
+		}
+		if !bytes.Equal(code, wantCode) {
+			t.Errorf("%s: code mismatch:\nhave: %x\nwant: %x", inst.Opcode, code, wantCode)
+		}
+		if err != nil {
+			var xedErr *ErrXED
+			if !errors.As(err, &xedErr) {
+				t.Errorf("%s: expected ErrXED, got %T", inst.Opcode, err)
+			}
+			continue
+		}
+		desc, err := replay.Describe(code)
+		if err != nil {
+			t.Errorf("%s: describe: %v", inst.Opcode, err)
+			continue
+		}
+		if want := inst.Opcode + "_IFORM"; desc.Iform != want {
+			t.Errorf("%s: iform mismatch:\nhave: %q\nwant: %q", inst.Opcode, desc.Iform, want)
+		}
+	}
+
+	_, err = replay.Encode(&Inst{Opcode: "MUL", Args: []Argument{&RegArgument{Name: "EAX"}}})
+	if !errors.Is(err, ErrNotRecorded) {
+		t.Errorf("unrecorded inst: unexpected error: %v", err)
+	}
+
+	badFixtures := []string{
+		"",
+		`{"key": "NOP {}", "hex": "90"}`,
+		`{"mode": 8}`,
+		"{\"mode\": 64}\n" + `{"hex": "90"}`,
+		"{\"mode\": 64}\n" + `{"key": "NOP {}"}`,
+		"{\"mode\": 64}\n" + `{"key": "NOP {}", "hex": "90", "error": "GENERAL_ERROR"}`,
+		"{\"mode\": 64}\n" + `{"key": `,
+	}
+	for _, data := range badFixtures {
+		if _, err := LoadFixture(strings.NewReader(data)); err == nil {
+			t.Errorf("expected error for %s", data)
+		}
+	}
+}
+
+func TestFixtureEncoderConcurrent(t *testing.T) {
+	var insts []*Inst
+	for i := 0; i < 100; i++ {
+		insts = append(insts, &Inst{
+			Opcode: fmt.Sprintf("OP%d", i),
+			Args:   []Argument{&ImmArgument{Width: 8, Value: uint64(i)}},
+		})
+	}
+
+	// Both recording and replaying are done concurrently;
+	// run with -race to check them.
+	forEachInst := func(fn func(inst *Inst)) {
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for _, inst := range insts {
+					fn(inst)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	recorder := &RecordingEncoder{Encoder: stubEncoder{}, Fixture: NewFixture(Mode64)}
+	forEachInst(func(inst *Inst) {
+		recorder.Encode(inst)
+	})
+	if recorder.Fixture.Len() != len(insts) {
+		t.Fatalf("recorded %d instructions, want %d", recorder.Fixture.Len(), len(insts))
+	}
+
+	replay := &FixtureEncoder{Fixture: recorder.Fixture}
+	var mu sync.Mutex
+	var errs []error
+	forEachInst(func(inst *Inst) {
+		code, err := replay.Encode(inst)
+		if err == nil {
+			_, err = replay.Describe(code)
+		}
+		if err != nil {
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+		}
+	})
+	for _, err := range errs {
+		t.Error(err)
+	}
+}
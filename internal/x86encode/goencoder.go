@@ -0,0 +1,472 @@
+package x86encode
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/arch/x86/x86csv"
+)
+
+// GoEncoder is a pure Go Encoder for VEX and EVEX encoded instructions.
+//
+// Instruction forms are described by x86.csv rows.
+// Only the subset that is required by avx512test is supported:
+// vector, opmask and general purpose registers, memory (including VSIB)
+// and imm8 operands, masking, embedded broadcast and disp8*N.
+// Zeroing-masking and embedded rounding are never encoded.
+//
+// Like XED, GoEncoder prefers VEX forms over EVEX ones and
+// uses the shortest displacement encoding by default.
+type GoEncoder struct {
+	mode          MachineMode
+	formsByOpcode map[string][]*goForm
+}
+
+// NewGoEncoder returns encoder for VEX and EVEX forms from insts
+// that are valid in the given machine mode.
+// Forms that use unsupported encoding features (including all legacy
+// encoded instructions, like branches) are ignored: Encode returns
+// ErrUnencodable for them.
+func NewGoEncoder(insts []*x86csv.Inst, mode MachineMode) *GoEncoder {
+	enc := &GoEncoder{mode: mode, formsByOpcode: map[string][]*goForm{}}
+	for _, inst := range insts {
+		valid := inst.Mode64
+		if mode != Mode64 {
+			valid = inst.Mode32
+		}
+		if valid != "V" {
+			continue
+		}
+		op := inst.IntelOpcode()
+		form, err := newGoForm(inst)
+		if err != nil {
+			// Opcode is still known, so it's reported as unencodable.
+			if _, ok := enc.formsByOpcode[op]; !ok {
+				enc.formsByOpcode[op] = nil
+			}
+			continue
+		}
+		enc.formsByOpcode[op] = append(enc.formsByOpcode[op], form)
+	}
+	// VEX forms are tried first, like XED does.
+	for _, forms := range enc.formsByOpcode {
+		sortGoForms(forms)
+	}
+	return enc
+}
+
+// Encode implements Encoder interface.
+func (enc *GoEncoder) Encode(inst *Inst) ([]byte, error) {
+	forms, ok := enc.formsByOpcode[inst.Opcode]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownOpcode, inst.Opcode)
+	}
+	if len(forms) == 0 {
+		return nil, ErrUnencodable
+	}
+
+	args, err := goOperands(inst, enc.mode)
+	if err != nil {
+		return nil, err
+	}
+	params := goParamsOf(inst)
+
+	for _, form := range forms {
+		if !form.match(args, &params) {
+			continue
+		}
+		code, err := form.encode(args, &params, enc.mode)
+		if err != nil {
+			continue // Try next form
+		}
+		return code, nil
+	}
+	return nil, ErrUnencodable
+}
+
+// goRegClass is a register class.
+type goRegClass int
+
+const (
+	goRegNone goRegClass = iota
+	goRegGPR32
+	goRegGPR64
+	goRegXMM
+	goRegYMM
+	goRegZMM
+	goRegK
+)
+
+// isVector reports whether c is XMM, YMM or ZMM register class.
+func (c goRegClass) isVector() bool {
+	return c == goRegXMM || c == goRegYMM || c == goRegZMM
+}
+
+// goReg is a register description.
+type goReg struct {
+	class goRegClass
+	num   int
+}
+
+var goRegByName = func() map[string]goReg {
+	regs := map[string]goReg{}
+	gpr := []string{"AX", "CX", "DX", "BX", "SP", "BP", "SI", "DI"}
+	for i, name := range gpr {
+		regs["E"+name] = goReg{goRegGPR32, i}
+		regs["R"+name] = goReg{goRegGPR64, i}
+	}
+	for i := 8; i < 16; i++ {
+		regs[fmt.Sprintf("R%dD", i)] = goReg{goRegGPR32, i}
+		regs[fmt.Sprintf("R%d", i)] = goReg{goRegGPR64, i}
+	}
+	for i := 0; i < 32; i++ {
+		regs[fmt.Sprintf("XMM%d", i)] = goReg{goRegXMM, i}
+		regs[fmt.Sprintf("YMM%d", i)] = goReg{goRegYMM, i}
+		regs[fmt.Sprintf("ZMM%d", i)] = goReg{goRegZMM, i}
+	}
+	for i := 0; i < 8; i++ {
+		regs[fmt.Sprintf("K%d", i)] = goReg{goRegK, i}
+	}
+	return regs
+}()
+
+// goOperand is Inst argument that is resolved for GoEncoder.
+type goOperand struct {
+	reg   goReg        // For RegArgument
+	mem   *MemArgument // For MemArgument
+	base  goReg        // Resolved mem.Base
+	index goReg        // Resolved mem.Index
+	imm   *ImmArgument // For ImmArgument
+}
+
+// goOperands resolves inst arguments.
+// Registers that are not available in mode are rejected.
+func goOperands(inst *Inst, mode MachineMode) ([]*goOperand, error) {
+	ops := make([]*goOperand, len(inst.Args))
+	for i, arg := range inst.Args {
+		op := &goOperand{}
+		var err error
+		switch arg := arg.(type) {
+		case *RegArgument:
+			op.reg, err = goModeRegister(arg.Name, mode)
+		case *ImmArgument:
+			op.imm = arg
+		case *MemArgument:
+			op.mem = arg
+			op.base, err = goModeRegister(arg.Base, mode)
+			if err == nil {
+				op.index, err = goModeRegister(arg.Index, mode)
+			}
+		default:
+			err = fmt.Errorf("invalid argument type: %T", arg)
+		}
+		if err != nil {
+			return nil, &ErrBadOperand{Index: i, Err: err}
+		}
+		ops[i] = op
+	}
+	return ops, nil
+}
+
+// goRegister returns register description for the given name.
+// Empty name is mapped to goRegNone class, which means "no register".
+func goRegister(name string) (goReg, error) {
+	if name == "" {
+		return goReg{}, nil
+	}
+	reg, ok := goRegByName[name]
+	if !ok {
+		return goReg{}, &ErrUnknownRegister{Name: name}
+	}
+	return reg, nil
+}
+
+// goModeRegister is like goRegister, but it also checks
+// that register can be encoded in the given machine mode.
+func goModeRegister(name string, mode MachineMode) (goReg, error) {
+	reg, err := goRegister(name)
+	if err != nil || mode == Mode64 {
+		return reg, err
+	}
+	if reg.class == goRegGPR64 || reg.num > 7 {
+		return reg, fmt.Errorf("%s is not available in %d-bit mode", name, mode.Bits())
+	}
+	return reg, nil
+}
+
+// goParams is Inst.Params summary.
+type goParams struct {
+	w    int // -1 if not specified
+	vl   int // Vector length in bits, 0 if not specified
+	bcst bool
+}
+
+func goParamsOf(inst *Inst) goParams {
+	params := goParams{w: -1}
+	for _, param := range inst.Params {
+		switch param {
+		case ParamRexW0:
+			params.w = 0
+		case ParamRexW1:
+			params.w = 1
+		case ParamVexL128:
+			params.vl = 128
+		case ParamVexL256:
+			params.vl = 256
+		case ParamVexL512:
+			params.vl = 512
+		case ParamBroadcast:
+			params.bcst = true
+		}
+	}
+	return params
+}
+
+// encode returns machine code for form with given operands.
+// Operands should be matched with form.match beforehand.
+func (form *goForm) encode(args []*goOperand, params *goParams, mode MachineMode) ([]byte, error) {
+	var (
+		reg   int // ModRM.reg or /digit
+		rm    *goOperand
+		vvvv  int
+		mask  int
+		imm   byte
+		vsibV int // VSIB index register bit 4
+	)
+	if form.digit >= 0 {
+		reg = form.digit
+	}
+	for i, spec := range form.ops {
+		arg := args[i]
+		switch spec.role {
+		case goRoleReg:
+			reg = arg.reg.num
+		case goRoleRM:
+			rm = arg
+		case goRoleVVVV:
+			vvvv = arg.reg.num
+		case goRoleMask:
+			mask = arg.reg.num
+		case goRoleImm:
+			imm = byte(arg.imm.Value)
+		}
+	}
+
+	w := form.w
+	if w < 0 {
+		w = params.w
+		if w < 0 {
+			w = 0
+		}
+	}
+	vl := form.vl
+	if vl == 0 {
+		vl = params.vl
+	}
+	bcst := params.bcst && rm != nil && rm.mem != nil
+
+	var rex struct{ x, b int } // Bit 3 of rm/SIB registers (X is bit 4 for rm register)
+	var modrm, sib []byte
+	var disp []byte
+	addrSize := 0
+	if rm == nil {
+		return nil, errors.New("no rm operand")
+	}
+	if rm.mem == nil {
+		modrm = []byte{0xC0 | byte(reg&7)<<3 | byte(rm.reg.num&7)}
+		rex.b = rm.reg.num >> 3 & 1
+		rex.x = rm.reg.num >> 4 & 1 // EVEX extends rm register with X
+	} else {
+		n := 1
+		if form.evex {
+			n = form.scale
+			if bcst {
+				n = form.bscale
+			}
+			if n == 0 {
+				n = 1
+			}
+		}
+		var err error
+		var m goMemEncoding
+		m, err = encodeGoMem(rm, n)
+		if err != nil {
+			return nil, err
+		}
+		modrm = []byte{m.mod<<6 | byte(reg&7)<<3 | m.rm}
+		sib = m.sib
+		disp = m.disp
+		rex.b = m.b
+		rex.x = m.x
+		vsibV = m.v
+		addrSize = m.addrSize
+	}
+
+	var code []byte
+	if addrSize != 0 && addrSize != mode.Bits() {
+		code = append(code, 0x67) // Address size override
+	}
+
+	if form.evex {
+		if bcst && form.bscale == 0 {
+			return nil, errors.New("broadcast is not supported")
+		}
+		vPrime := vvvv >> 4 & 1
+		if rm.mem != nil && rm.index.class.isVector() {
+			// VSIB index extension is stored in V' bit.
+			// Forms with VSIB operand have no vvvv operand.
+			vPrime = vsibV
+		}
+		ll := map[int]byte{0: 0, 128: 0, 256: 1, 512: 2}[vl]
+		p0 := byte(^(reg>>3)&1)<<7 |
+			byte(^rex.x&1)<<6 |
+			byte(^rex.b&1)<<5 |
+			byte(^(reg>>4)&1)<<4 |
+			form.mmmmm
+		p1 := byte(w)<<7 | byte(^vvvv&0xF)<<3 | 1<<2 | form.pp
+		p2 := ll<<5 | byte(^vPrime&1)<<3 | byte(mask&7)
+		if bcst {
+			p2 |= 1 << 4
+		}
+		code = append(code, 0x62, p0, p1, p2)
+	} else {
+		if reg > 15 || vvvv > 15 || vsibV != 0 || vl == 512 || bcst || mask != 0 ||
+			(rm.mem == nil && rm.reg.num > 15) {
+			return nil, errors.New("operands are not VEX-encodable")
+		}
+		l := byte(0)
+		if vl == 256 {
+			l = 1
+		}
+		r := byte(^(reg>>3)&1) << 7
+		tail := byte(^vvvv&0xF)<<3 | l<<2 | form.pp
+		if rex.x == 0 && rex.b == 0 && w == 0 && form.mmmmm == 1 {
+			code = append(code, 0xC5, r|tail)
+		} else {
+			p1 := r | byte(^rex.x&1)<<6 | byte(^rex.b&1)<<5 | form.mmmmm
+			code = append(code, 0xC4, p1, byte(w)<<7|tail)
+		}
+	}
+
+	code = append(code, form.opcode)
+	code = append(code, modrm...)
+	code = append(code, sib...)
+	code = append(code, disp...)
+	if form.imm8 {
+		code = append(code, imm)
+	}
+	return code, nil
+}
+
+// goMemEncoding is an encoded memory operand.
+type goMemEncoding struct {
+	mod      byte
+	rm       byte
+	sib      []byte
+	disp     []byte
+	b        int // Base register bit 3
+	x        int // Index register bit 3
+	v        int // VSIB index register bit 4
+	addrSize int // Address registers width, 0 if there are none
+}
+
+// encodeGoMem encodes memory operand with disp8*N compression factor n.
+func encodeGoMem(op *goOperand, n int) (goMemEncoding, error) {
+	var m goMemEncoding
+	mem := op.mem
+
+	switch op.base.class {
+	case goRegNone:
+	case goRegGPR32:
+		m.addrSize = 32
+	case goRegGPR64:
+		m.addrSize = 64
+	default:
+		return m, errors.New("bad base register")
+	}
+	vsib := false
+	switch op.index.class {
+	case goRegNone:
+	case goRegGPR32:
+		m.addrSize = 32
+	case goRegGPR64:
+		m.addrSize = 64
+	case goRegXMM, goRegYMM, goRegZMM:
+		vsib = true
+	default:
+		return m, errors.New("bad index register")
+	}
+	if op.base.class != goRegNone && op.index.class != goRegNone && !vsib &&
+		op.base.class != op.index.class {
+		return m, errors.New("mixed address size")
+	}
+	if !vsib && op.index.class != goRegNone && op.index.num == 4 {
+		return m, errors.New("SP can't be used as index")
+	}
+
+	scaleBits := map[int]byte{0: 0, 1: 0, 2: 1, 4: 2, 8: 3}
+	ss, ok := scaleBits[mem.Scale]
+	if !ok {
+		return m, fmt.Errorf("invalid memory argument scale: %d", mem.Scale)
+	}
+
+	disp8 := func() bool {
+		return mem.Disp%int32(n) == 0 && mem.Disp/int32(n) >= -128 && mem.Disp/int32(n) <= 127
+	}
+	noBase := op.base.class == goRegNone
+	switch mem.DispWidth {
+	case DispSmallest:
+		switch {
+		case noBase:
+			m.mod = 0
+		case mem.Disp == 0 && op.base.num&7 != 5:
+			m.mod = 0
+		case disp8():
+			m.mod = 1
+		default:
+			m.mod = 2
+		}
+	case Disp8:
+		if noBase || !disp8() {
+			return m, errors.New("displacement can't be encoded as disp8")
+		}
+		m.mod = 1
+	case Disp32:
+		m.mod = 2
+		if noBase {
+			m.mod = 0
+		}
+	default:
+		return m, fmt.Errorf("invalid memory argument disp width: %d", mem.DispWidth)
+	}
+
+	switch {
+	case m.mod == 1:
+		m.disp = []byte{byte(mem.Disp / int32(n))}
+	case m.mod == 2 || noBase:
+		d := uint32(mem.Disp)
+		m.disp = []byte{byte(d), byte(d >> 8), byte(d >> 16), byte(d >> 24)}
+	}
+
+	needSIB := noBase || op.index.class != goRegNone || op.base.num&7 == 4
+	if !needSIB {
+		m.rm = byte(op.base.num & 7)
+		m.b = op.base.num >> 3 & 1
+		return m, nil
+	}
+
+	m.rm = 4
+	index := byte(4) // No index
+	if op.index.class != goRegNone {
+		index = byte(op.index.num & 7)
+		m.x = op.index.num >> 3 & 1
+		m.v = op.index.num >> 4 & 1
+	}
+	base := byte(5) // No base
+	if !noBase {
+		base = byte(op.base.num & 7)
+		m.b = op.base.num >> 3 & 1
+	}
+	m.sib = []byte{ss<<6 | index<<3 | base}
+	return m, nil
+}
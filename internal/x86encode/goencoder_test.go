@@ -0,0 +1,312 @@
+package x86encode
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"golang.org/x/arch/x86/x86csv"
+)
+
+func newTestGoEncoder(t *testing.T, mode MachineMode) *GoEncoder {
+	f, err := os.Open("../../x86.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	insts, err := x86csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewGoEncoder(insts, mode)
+}
+
+func TestGoEncoder(t *testing.T) {
+	type reg = RegArgument
+	type imm = ImmArgument
+	type mem = MemArgument
+
+	encoder := newTestGoEncoder(t, Mode64)
+
+	// Expected encodings are taken from XED.
+	tests := []struct {
+		inst Inst
+		want string
+	}{
+		{
+			Inst{
+				Opcode: "VAESDEC",
+				Args: []Argument{
+					&reg{Name: "XMM11"},
+					&reg{Name: "XMM12"},
+					&mem{Base: "EDX", Width: 128},
+				},
+			},
+			"67c46219de1a",
+		},
+
+		{
+			Inst{
+				Opcode: "VADDPD",
+				Params: []InstParam{ParamVexL256},
+				Args: []Argument{
+					&reg{Name: "YMM0"},
+					&reg{Name: "K3"},
+					&reg{Name: "YMM5"},
+					&reg{Name: "YMM22"},
+				},
+			},
+			"62b1d52b58c6",
+		},
+
+		{
+			Inst{
+				Opcode: "VANDPD",
+				Params: []InstParam{ParamRexW1},
+				Args: []Argument{
+					&reg{Name: "XMM0"},
+					&reg{Name: "K3"},
+					&reg{Name: "XMM5"},
+					&reg{Name: "XMM22"},
+				},
+			},
+			"62b1d50b54c6",
+		},
+
+		{
+			Inst{
+				Opcode: "VADDPD",
+				Params: []InstParam{ParamRexW1, ParamVexL512},
+				Args: []Argument{
+					&reg{Name: "ZMM0"},
+					&reg{Name: "K3"},
+					&reg{Name: "ZMM5"},
+					&mem{Base: "RAX", Width: 512, Disp: 128, DispWidth: Disp8},
+				},
+			},
+			"62f1d54b584002",
+		},
+
+		{
+			Inst{
+				Opcode: "VADDPD",
+				Params: []InstParam{ParamRexW1, ParamVexL512},
+				Args: []Argument{
+					&reg{Name: "ZMM0"},
+					&reg{Name: "K3"},
+					&reg{Name: "ZMM5"},
+					&mem{Base: "RAX", Width: 512, Disp: 65, DispWidth: Disp32},
+				},
+			},
+			"62f1d54b588041000000",
+		},
+
+		{
+			Inst{
+				Opcode: "VADDPD",
+				Params: []InstParam{ParamRexW1, ParamVexL512, ParamBroadcast},
+				Args: []Argument{
+					&reg{Name: "ZMM0"},
+					&reg{Name: "K3"},
+					&reg{Name: "ZMM5"},
+					&mem{Base: "RAX", Width: 64, Disp: 8, DispWidth: Disp8},
+				},
+			},
+			"62f1d55b584001",
+		},
+
+		{
+			Inst{
+				Opcode: "VPGATHERDD",
+				Params: []InstParam{ParamRexW0, ParamVexL512},
+				Args: []Argument{
+					&reg{Name: "ZMM3"},
+					&reg{Name: "K1"},
+					&mem{Base: "RAX", Index: "ZMM17", Scale: 4, Disp: 8, Width: 32},
+				},
+			},
+			"62f27d41905c8802",
+		},
+
+		{
+			Inst{
+				Opcode: "VPSHUFD",
+				Params: []InstParam{ParamVexL512},
+				Args: []Argument{
+					&reg{Name: "ZMM1"},
+					&reg{Name: "K0"},
+					&reg{Name: "ZMM2"},
+					&imm{Value: 7, Width: 8},
+				},
+			},
+			"62f17d4870ca07",
+		},
+
+		{
+			Inst{
+				Opcode: "KNOTQ",
+				Params: []InstParam{ParamRexW1},
+				Args: []Argument{
+					&reg{Name: "K1"},
+					&reg{Name: "K1"},
+				},
+			},
+			"c4e1f844c9",
+		},
+
+		{
+			Inst{
+				Opcode: "KORD",
+				Params: []InstParam{ParamRexW1, ParamVexL256},
+				Args: []Argument{
+					&reg{Name: "K6"},
+					&reg{Name: "K1"},
+					&reg{Name: "K3"},
+				},
+			},
+			"c4e1f545f3",
+		},
+	}
+
+	for _, test := range tests {
+		code, err := encoder.Encode(&test.inst)
+		if err != nil {
+			t.Errorf("%s: encoding failed: %v", test.inst.Opcode, err)
+			continue
+		}
+		if have := fmt.Sprintf("%x", code); have != test.want {
+			t.Errorf("%s: encoding result mismatch:\nhave: %q\nwant: %q",
+				test.inst.Opcode, have, test.want)
+		}
+	}
+}
+
+func TestGoEncoderErrors(t *testing.T) {
+	type reg = RegArgument
+	type mem = MemArgument
+
+	encoder := newTestGoEncoder(t, Mode64)
+
+	tests := []struct {
+		inst Inst
+		want error
+	}{
+		{Inst{Opcode: "BADOP"}, ErrUnknownOpcode},
+		{Inst{Opcode: "JMP", Args: []Argument{&RelArgument{Width: 8}}}, ErrUnencodable},
+
+		{
+			Inst{
+				Opcode: "VADDPD",
+				Args: []Argument{
+					&reg{Name: "ZMM0"},
+					&reg{Name: "K3"},
+					&reg{Name: "ZMM55"},
+					&reg{Name: "ZMM1"},
+				},
+			},
+			&ErrBadOperand{},
+		},
+
+		{
+			Inst{
+				Opcode: "VADDPD",
+				Params: []InstParam{ParamVexL512},
+				Args: []Argument{
+					&reg{Name: "ZMM0"},
+					&reg{Name: "K3"},
+					&reg{Name: "XMM5"},
+					&reg{Name: "ZMM1"},
+				},
+			},
+			ErrUnencodable,
+		},
+
+		{
+			Inst{
+				Opcode: "VPGATHERDD",
+				Params: []InstParam{ParamVexL512},
+				Args: []Argument{
+					&reg{Name: "ZMM3"},
+					&reg{Name: "K1"},
+					&mem{Base: "RAX", Index: "RCX", Width: 32},
+				},
+			},
+			ErrUnencodable,
+		},
+	}
+
+	for _, test := range tests {
+		_, err := encoder.Encode(&test.inst)
+		if err == nil {
+			t.Errorf("%s: expected error", test.inst.Opcode)
+			continue
+		}
+		var ok bool
+		switch want := test.want.(type) {
+		case *ErrBadOperand:
+			ok = errors.As(err, &want)
+		default:
+			ok = errors.Is(err, want)
+		}
+		if !ok {
+			t.Errorf("%s: unexpected error: %v", test.inst.Opcode, err)
+		}
+	}
+}
+
+func TestGoEncoderMode32(t *testing.T) {
+	type reg = RegArgument
+	type mem = MemArgument
+
+	encoder := newTestGoEncoder(t, Mode32)
+
+	code, err := encoder.Encode(&Inst{
+		Opcode: "VAESDEC",
+		Args: []Argument{
+			&reg{Name: "XMM3"},
+			&reg{Name: "XMM4"},
+			&mem{Base: "EDX", Width: 128},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := fmt.Sprintf("%x", code); have != "c4e259de1a" {
+		t.Errorf("VAESDEC:\nhave: %s\nwant: %s", have, "c4e259de1a")
+	}
+
+	badInsts := []Inst{
+		{
+			Opcode: "VAESDEC",
+			Args: []Argument{
+				&reg{Name: "XMM11"},
+				&reg{Name: "XMM4"},
+				&mem{Base: "EDX", Width: 128},
+			},
+		},
+		{
+			Opcode: "VAESDEC",
+			Args: []Argument{
+				&reg{Name: "XMM3"},
+				&reg{Name: "XMM4"},
+				&mem{Base: "RDX", Width: 128},
+			},
+		},
+		{
+			Opcode: "VADDPD",
+			Params: []InstParam{ParamVexL512},
+			Args: []Argument{
+				&reg{Name: "ZMM0"},
+				&reg{Name: "K3"},
+				&reg{Name: "ZMM16"},
+				&reg{Name: "ZMM1"},
+			},
+		},
+	}
+	for _, inst := range badInsts {
+		if _, err := encoder.Encode(&inst); err == nil {
+			t.Errorf("%s %v: expected error", inst.Opcode, inst.Args)
+		}
+	}
+}
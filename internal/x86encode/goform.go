@@ -0,0 +1,341 @@
+package x86encode
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/arch/x86/x86csv"
+)
+
+// goOperandRole describes where operand is encoded.
+type goOperandRole int
+
+const (
+	goRoleReg  goOperandRole = iota // ModRM.reg
+	goRoleRM                        // ModRM.rm (and SIB)
+	goRoleVVVV                      // VEX/EVEX vvvv
+	goRoleMask                      // EVEX aaa
+	goRoleImm                       // imm8
+)
+
+// goOperandSpec describes x86.csv operand, like "zmm2/m512/m64bcst".
+type goOperandSpec struct {
+	role   goOperandRole
+	syntax string
+
+	regs      []goRegClass // Accepted register classes
+	mem       bool         // Whether memory operand is accepted
+	memWidths []uint       // Accepted memory operand widths
+	bcstWidth uint         // Broadcast element width, 0 if broadcast is not supported
+	vsib      goRegClass   // VSIB index register class, goRegNone for non-VSIB memory
+}
+
+// goForm is an instruction form that is parsed from x86.csv row.
+type goForm struct {
+	evex   bool
+	pp     byte // Implied legacy prefix: 0 (none), 1 (66), 2 (F3) or 3 (F2)
+	mmmmm  byte // Opcode map: 1 (0F), 2 (0F38) or 3 (0F3A)
+	vl     int  // Vector length in bits, 0 for LIG
+	w      int  // W bit, -1 for WIG
+	opcode byte
+	digit  int // ModRM.reg opcode extension, -1 for /r
+	imm8   bool
+
+	scale  int // disp8*N factor
+	bscale int // disp8*N factor for broadcast
+
+	ops []*goOperandSpec
+}
+
+// sortGoForms puts VEX forms before EVEX forms.
+// Relative order of the forms is preserved otherwise.
+func sortGoForms(forms []*goForm) {
+	sort.SliceStable(forms, func(i, j int) bool {
+		return !forms[i].evex && forms[j].evex
+	})
+}
+
+func newGoForm(inst *x86csv.Inst) (*goForm, error) {
+	form := &goForm{digit: -1, w: -1}
+
+	fields := strings.Fields(inst.Encoding)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("unsupported encoding: %q", inst.Encoding)
+	}
+
+	prefix := strings.Split(fields[0], ".")
+	switch prefix[0] {
+	case "VEX":
+	case "EVEX":
+		form.evex = true
+	default:
+		return nil, fmt.Errorf("unsupported encoding: %q", inst.Encoding)
+	}
+	for _, p := range prefix[1:] {
+		switch p {
+		case "NDS", "NDD", "DDS":
+			// vvvv operand is detected by operand syntax.
+		case "128", "L0", "LZ":
+			form.vl = 128
+		case "256", "L1":
+			form.vl = 256
+		case "512":
+			form.vl = 512
+		case "LIG":
+			form.vl = 0
+		case "66":
+			form.pp = 1
+		case "F3":
+			form.pp = 2
+		case "F2":
+			form.pp = 3
+		case "0F":
+			form.mmmmm = 1
+		case "0F38":
+			form.mmmmm = 2
+		case "0F3A":
+			form.mmmmm = 3
+		case "W0":
+			form.w = 0
+		case "W1":
+			form.w = 1
+		case "WIG":
+			form.w = -1
+		default:
+			return nil, fmt.Errorf("unsupported encoding prefix part: %q", p)
+		}
+	}
+	if form.mmmmm == 0 {
+		return nil, fmt.Errorf("no opcode map: %q", inst.Encoding)
+	}
+
+	opcode, err := strconv.ParseUint(fields[1], 16, 8)
+	if err != nil {
+		return nil, fmt.Errorf("bad opcode: %q", fields[1])
+	}
+	form.opcode = byte(opcode)
+
+	hasModRM := false
+	for _, f := range fields[2:] {
+		switch {
+		case f == "/r" || f == "/vsib":
+			hasModRM = true
+		case len(f) == 2 && f[0] == '/' && f[1] >= '0' && f[1] <= '7':
+			hasModRM = true
+			form.digit = int(f[1] - '0')
+		case f == "ib":
+			form.imm8 = true
+		default:
+			return nil, fmt.Errorf("unsupported encoding part: %q", f)
+		}
+	}
+	if !hasModRM {
+		return nil, errors.New("forms without ModRM are not supported")
+	}
+
+	for _, tag := range strings.Split(inst.Tags, ",") {
+		switch {
+		case strings.HasPrefix(tag, "bscale"):
+			form.bscale, _ = strconv.Atoi(strings.TrimPrefix(tag, "bscale"))
+		case strings.HasPrefix(tag, "scale"):
+			form.scale, _ = strconv.Atoi(strings.TrimPrefix(tag, "scale"))
+		}
+	}
+
+	var main []*goOperandSpec // Operands that are encoded inside ModRM
+	for _, arg := range inst.IntelArgs() {
+		spec, err := parseGoOperandSpec(arg)
+		if err != nil {
+			return nil, err
+		}
+		if spec.role == goRoleRM {
+			main = append(main, spec)
+		}
+		form.ops = append(form.ops, spec)
+	}
+
+	switch {
+	case len(main) == 1 && form.digit >= 0:
+		// Single operand is rm.
+	case len(main) == 2 && form.digit < 0:
+		// Operand that can be a memory is always encoded as rm.
+		// Otherwise, rm operand is either named like "xmm2"
+		// or "rmr32", or it is the last operand.
+		if main[0].isRM() && !main[1].isRM() {
+			main[1].role = goRoleReg // Store form, like "m512, {k}, zmm1"
+		} else {
+			main[0].role = goRoleReg
+		}
+	default:
+		return nil, fmt.Errorf("unsupported operands: %q", inst.Intel)
+	}
+
+	return form, nil
+}
+
+// goOperandSpecReplacer erases operand syntax parts that are not encoded.
+var goOperandSpecReplacer = strings.NewReplacer(
+	"{sae}", "",
+	"{er}", "",
+)
+
+func parseGoOperandSpec(syntax string) (*goOperandSpec, error) {
+	syntax = goOperandSpecReplacer.Replace(syntax)
+
+	switch {
+	case syntax == "{k}" || syntax == "{k}{z}" || syntax == "{k1-k7}":
+		return &goOperandSpec{role: goRoleMask, regs: []goRegClass{goRegK}}, nil
+	case strings.HasPrefix(syntax, "imm8"):
+		return &goOperandSpec{role: goRoleImm}, nil
+	}
+
+	if reg := strings.TrimSuffix(syntax, "+3"); strings.HasSuffix(reg, "V") {
+		class := goRegClassBySyntax(strings.TrimSuffix(reg, "V"))
+		if class == goRegNone {
+			return nil, fmt.Errorf("unsupported operand: %q", syntax)
+		}
+		return &goOperandSpec{role: goRoleVVVV, regs: []goRegClass{class}}, nil
+	}
+
+	spec := &goOperandSpec{role: goRoleRM, syntax: syntax}
+	alternatives := strings.Split(syntax, "/")
+	for _, alt := range alternatives {
+		switch {
+		case alt == "r":
+			// "r/m32" and "r/m64" forms.
+			switch alternatives[len(alternatives)-1] {
+			case "m32":
+				spec.regs = append(spec.regs, goRegGPR32)
+			case "m64":
+				spec.regs = append(spec.regs, goRegGPR64)
+			default:
+				return nil, fmt.Errorf("unsupported operand: %q", syntax)
+			}
+		case strings.HasPrefix(alt, "vm") && len(alt) == 5:
+			spec.mem = true
+			spec.vsib = map[byte]goRegClass{'x': goRegXMM, 'y': goRegYMM, 'z': goRegZMM}[alt[4]]
+			if spec.vsib == goRegNone {
+				return nil, fmt.Errorf("unsupported operand: %q", syntax)
+			}
+		case strings.HasPrefix(alt, "m") && strings.HasSuffix(alt, "bcst"):
+			spec.mem = true
+			width, err := strconv.Atoi(strings.TrimSuffix(alt[1:], "bcst"))
+			if err != nil {
+				return nil, fmt.Errorf("unsupported operand: %q", syntax)
+			}
+			spec.bcstWidth = uint(width)
+		case strings.HasPrefix(alt, "m"):
+			spec.mem = true
+			if alt == "m" {
+				continue // Any width
+			}
+			width, err := strconv.Atoi(alt[1:])
+			if err != nil {
+				return nil, fmt.Errorf("unsupported operand: %q", syntax)
+			}
+			spec.memWidths = append(spec.memWidths, uint(width))
+		default:
+			// "rmr32" is r32 that is encoded as ModRM.rm.
+			name := strings.TrimPrefix(alt, "rm")
+			class := goRegClassBySyntax(name)
+			if class == goRegNone {
+				class = goRegClassBySyntax(strings.TrimRight(name, "0123456789"))
+			}
+			if class == goRegNone {
+				return nil, fmt.Errorf("unsupported operand: %q", syntax)
+			}
+			spec.regs = append(spec.regs, class)
+		}
+	}
+	return spec, nil
+}
+
+// isRM reports whether operand syntax suggests ModRM.rm encoding.
+func (spec *goOperandSpec) isRM() bool {
+	first := strings.Split(spec.syntax, "/")[0]
+	return spec.mem ||
+		strings.HasPrefix(first, "rm") ||
+		strings.HasSuffix(first, "2")
+}
+
+// goRegClassBySyntax maps x86.csv register operand syntax
+// without numeric suffix, like "zmm" or "r32", to register class.
+func goRegClassBySyntax(syntax string) goRegClass {
+	switch syntax {
+	case "xmm":
+		return goRegXMM
+	case "ymm":
+		return goRegYMM
+	case "zmm":
+		return goRegZMM
+	case "k":
+		return goRegK
+	case "r32":
+		return goRegGPR32
+	case "r64":
+		return goRegGPR64
+	default:
+		return goRegNone
+	}
+}
+
+// match reports whether form can encode args with given params.
+func (form *goForm) match(args []*goOperand, params *goParams) bool {
+	if len(args) != len(form.ops) {
+		return false
+	}
+	if form.vl != 0 && params.vl != 0 && form.vl != params.vl {
+		return false
+	}
+	if form.w >= 0 && params.w >= 0 && form.w != params.w {
+		return false
+	}
+	for i, spec := range form.ops {
+		if !spec.accepts(args[i], params.bcst) {
+			return false
+		}
+	}
+	return true
+}
+
+func (spec *goOperandSpec) accepts(arg *goOperand, bcst bool) bool {
+	switch {
+	case spec.role == goRoleImm:
+		return arg.imm != nil
+	case arg.mem != nil:
+		if spec.role != goRoleRM || !spec.mem {
+			return false
+		}
+		if spec.vsib != goRegNone {
+			return !bcst && arg.index.class == spec.vsib
+		}
+		if arg.index.class.isVector() {
+			return false
+		}
+		width := arg.mem.Width
+		if bcst {
+			return spec.bcstWidth != 0 && (width == 0 || width == spec.bcstWidth)
+		}
+		if width == 0 || len(spec.memWidths) == 0 {
+			return true
+		}
+		for _, w := range spec.memWidths {
+			if w == width {
+				return true
+			}
+		}
+		return false
+	case arg.reg.class != goRegNone:
+		for _, class := range spec.regs {
+			if class == arg.reg.class {
+				return !bcst || spec.role != goRoleRM
+			}
+		}
+		return false
+	default:
+		return false
+	}
+}
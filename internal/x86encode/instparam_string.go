@@ -4,9 +4,9 @@ package x86encode
 
 import "strconv"
 
-const _InstParam_name = "ParamBadParamRexW0ParamRexW1ParamVexL128ParamVexL256ParamVexL512ParamEOSZ8ParamEOSZ16ParamEOSZ32ParamEOSZ64"
+const _InstParam_name = "ParamBadParamRexW0ParamRexW1ParamVexL128ParamVexL256ParamVexL512ParamEOSZ8ParamEOSZ16ParamEOSZ32ParamEOSZ64ParamBroadcast"
 
-var _InstParam_index = [...]uint8{0, 8, 18, 28, 40, 52, 64, 74, 85, 96, 107}
+var _InstParam_index = [...]uint8{0, 8, 18, 28, 40, 52, 64, 74, 85, 96, 107, 121}
 
 func (i InstParam) String() string {
 	if i < 0 || i >= InstParam(len(_InstParam_index)-1) {
@@ -1,11 +1,17 @@
 // Package x86encode implements simple x86 instructions encoder.
 //
-// Ignores existence of 32-bit CPU mode.
-// Ignores existence of multi-immediate operands instructions.
-// Ignores many other avx512test-irrelevant things, like rel-operands and so on.
+// Instructions are encoded for 64-bit mode, unless other
+// MachineMode is requested (see Options and NewGoEncoder).
+// Ignores many other avx512test-irrelevant things, like segment override prefixes.
 // This package exists solely to satisfy avx512test needs.
 //
-// Uses Intel XED under the hood.
+// Encoding backends implement Encoder interface.
+// XEDEncoder uses Intel XED under the hood; New creates it
+// for the given Options. Package-level functions, like ToHexString
+// and Encode, use a shared 64-bit mode XEDEncoder.
+// GoEncoder is a pure Go VEX/EVEX encoder that works without cgo;
+// XED functions return errors when the package is built without cgo.
+// FixtureEncoder replays results recorded by RecordingEncoder.
 package x86encode
 
 import (
@@ -20,7 +26,82 @@ import (
 // regarding which form will be used. It can also vary between
 // different XED versions.
 func ToHexString(inst *Inst) (string, error) {
-	return encodeToHexString(inst)
+	code, err := defaultEncoder.Encode(inst)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", code), nil
+}
+
+// defaultEncoder is a 64-bit mode encoder that is used
+// by the package-level functions.
+var defaultEncoder XEDEncoder
+
+// XEDVersion returns version string of the XED library
+// that is used for encoding.
+func XEDVersion() string {
+	return xedVersion()
+}
+
+// Encode is like ToHexString, but also reports which instruction form
+// was selected by the encoder and how the displacement was encoded.
+func Encode(inst *Inst) (*Encoding, error) {
+	code, err := defaultEncoder.Encode(inst)
+	if err != nil {
+		return nil, err
+	}
+	return defaultEncoder.Describe(code)
+}
+
+// EncodeBatch is like calling ToHexString for every inst, but all
+// instructions are encoded by XED in a single cgo call and
+// machine code is returned as bytes.
+//
+// Results are index-aligned with insts: for every i,
+// either codes[i] or errs[i] is set.
+func EncodeBatch(insts []*Inst) (codes [][]byte, errs []error) {
+	return defaultEncoder.EncodeBatch(insts)
+}
+
+// Syntax is an assembly syntax flavor.
+type Syntax int
+
+const (
+	SyntaxIntel Syntax = iota
+	SyntaxATT
+)
+
+// Disassemble returns textual representation of the encoded instruction
+// in requested syntax. Code is expected to contain exactly one instruction.
+//
+// Output is produced by the XED formatter, so it may differ from
+// the syntax that is accepted by other assemblers in minor details.
+func Disassemble(code []byte, syntax Syntax) (string, error) {
+	return defaultEncoder.Disassemble(code, syntax)
+}
+
+// Encoding describes encoded instruction.
+type Encoding struct {
+	// Hex is encoded instruction octets in the same format
+	// that is used by ToHexString.
+	Hex string
+
+	// Iform is an XED instruction form name, like "VADDPD_ZMMf64_MASKmskw_ZMMf64_MEMf64_AVX512".
+	Iform string
+
+	// TupleType is EVEX compressed displacement tuple type, like "FULL" or "TUPLE1".
+	//
+	// Empty string means that instruction can't use disp8*N encoding.
+	TupleType string
+
+	// DispScale is a compressed displacement scaling factor (N).
+	//
+	// Zero value means that instruction has no memory operand
+	// or can't use disp8*N encoding.
+	DispScale int
+
+	// DispCompressed is true if displacement was encoded as disp8*N.
+	DispCompressed bool
 }
 
 // Inst describes a single instruction to be encoded.
@@ -47,6 +128,7 @@ const (
 	ParamEOSZ16
 	ParamEOSZ32
 	ParamEOSZ64
+	ParamBroadcast
 )
 
 type DisplacementKind int
@@ -58,7 +140,7 @@ const (
 )
 
 // Argument carries arbitrary instruction operand.
-// Can be memory, immediate or register.
+// Can be memory, immediate, register, relative branch target or far pointer.
 type Argument interface {
 	argument()
 }
@@ -69,7 +151,10 @@ type RegArgument struct {
 }
 
 // ImmArgument describes immediate (const) operand.
-// There can be only one such operand (if explicit operands are considered).
+//
+// Most instructions have at most one immediate operand.
+// A few, like ENTER and EXTRQ, have two: the second one (in Args order)
+// is encoded as an additional 8-bit immediate (XED IMM1).
 type ImmArgument struct {
 	// Unsigned is true for uint-like arguments.
 	// False for int-like arguments.
@@ -81,7 +166,10 @@ type ImmArgument struct {
 	//	8  | uint8  or int8
 	//	16 | uint16 or int16
 	//	32 | uint32 or int32
-	//	64 | uint64
+	//	64 | uint64 or int64
+	//
+	// Signed immediates of width 8, 16 and 32 are sign-extended
+	// to the operand size; 64-bit immediates are encoded as is.
 	Width uint
 
 	// Value holds uninterpreted integer value of immediate operand.
@@ -130,19 +218,35 @@ type MemArgument struct {
 	DispWidth DisplacementKind
 }
 
-func (*RegArgument) argument() {}
-func (*ImmArgument) argument() {}
-func (*MemArgument) argument() {}
+// RelArgument describes relative branch target operand (rel8, rel16 or rel32).
+type RelArgument struct {
+	// Width is a branch displacement width in bits: 8, 16 or 32.
+	Width uint
 
-func encodeToHexString(inst *Inst) (string, error) {
-	encoding, err := encodeToBytes(inst)
-	if err != nil {
-		return "", err
-	}
-	return fmt.Sprintf("%x", encoding), nil
+	// Offset is a branch target offset relative to
+	// the end of the branch instruction.
+	Offset int32
+
+	// Label is an optional symbolic name of the branch target.
+	// It's only used for printing and does not affect encoding.
+	Label string
 }
 
-func encodeToBytes(inst *Inst) ([]byte, error) {
-	xedTablesInit() // Safe to be called multiple times
-	return xedEncode(inst)
+// PtrArgument describes far pointer operand (ptr16:16 or ptr16:32).
+// Far pointers are only valid outside of 64-bit mode.
+type PtrArgument struct {
+	// Width is an offset width in bits: 16 or 32.
+	Width uint
+
+	// Selector is a 16-bit segment selector.
+	Selector uint16
+
+	// Offset is an offset inside the selected segment.
+	Offset uint32
 }
+
+func (*RegArgument) argument() {}
+func (*ImmArgument) argument() {}
+func (*MemArgument) argument() {}
+func (*RelArgument) argument() {}
+func (*PtrArgument) argument() {}
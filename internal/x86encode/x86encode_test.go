@@ -1,6 +1,13 @@
+//go:build cgo
+// +build cgo
+
 package x86encode
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
 	"testing"
 )
 
@@ -36,6 +43,41 @@ func TestEncode(t *testing.T) {
 			"83c010",
 		},
 
+		{
+			Inst{
+				Opcode: "MOV",
+				Params: []InstParam{ParamEOSZ64},
+				Args: []Argument{
+					&reg{Name: "RAX"},
+					&imm{Value: 0xfffffffffffffffe, Width: 64},
+				},
+			},
+			"48b8feffffffffffffff",
+		},
+
+		{
+			Inst{
+				Opcode: "EXTRQ",
+				Args: []Argument{
+					&reg{Name: "XMM1"},
+					&imm{Value: 0x02, Width: 8, Unsigned: true},
+					&imm{Value: 0x03, Width: 8, Unsigned: true},
+				},
+			},
+			"660f78c10203",
+		},
+
+		{
+			Inst{
+				Opcode: "ENTER",
+				Args: []Argument{
+					&imm{Value: 0x10, Width: 16, Unsigned: true},
+					&imm{Value: 0x01, Width: 8, Unsigned: true},
+				},
+			},
+			"c8100001",
+		},
+
 		{
 			Inst{
 				Opcode: "VAESDEC",
@@ -76,6 +118,48 @@ func TestEncode(t *testing.T) {
 			"62b1d50b54c6",
 		},
 
+		{
+			Inst{
+				Opcode: "VADDPD",
+				Params: []InstParam{ParamRexW1, ParamVexL512},
+				Args: []Argument{
+					&reg{Name: "ZMM0"},
+					&reg{Name: "K3"},
+					&reg{Name: "ZMM5"},
+					&mem{Base: "RAX", Width: 512, Disp: 128, DispWidth: Disp8},
+				},
+			},
+			"62f1d54b584002",
+		},
+
+		{
+			Inst{
+				Opcode: "VADDPD",
+				Params: []InstParam{ParamRexW1, ParamVexL512},
+				Args: []Argument{
+					&reg{Name: "ZMM0"},
+					&reg{Name: "K3"},
+					&reg{Name: "ZMM5"},
+					&mem{Base: "RAX", Width: 512, Disp: 65, DispWidth: Disp32},
+				},
+			},
+			"62f1d54b588041000000",
+		},
+
+		{
+			Inst{
+				Opcode: "VADDPD",
+				Params: []InstParam{ParamRexW1, ParamVexL512, ParamBroadcast},
+				Args: []Argument{
+					&reg{Name: "ZMM0"},
+					&reg{Name: "K3"},
+					&reg{Name: "ZMM5"},
+					&mem{Base: "RAX", Width: 64, Disp: 8, DispWidth: Disp8},
+				},
+			},
+			"62f1d55b584001",
+		},
+
 		{
 			Inst{
 				Opcode: "KNOTQ",
@@ -114,3 +198,593 @@ func TestEncode(t *testing.T) {
 		}
 	}
 }
+
+func TestEncodeDispScale(t *testing.T) {
+	type reg = RegArgument
+	type mem = MemArgument
+
+	tests := []struct {
+		inst Inst
+		want Encoding
+	}{
+		{
+			Inst{
+				Opcode: "VADDPD",
+				Params: []InstParam{ParamRexW1, ParamVexL512},
+				Args: []Argument{
+					&reg{Name: "ZMM0"},
+					&reg{Name: "K3"},
+					&reg{Name: "ZMM5"},
+					&mem{Base: "RAX", Width: 512, Disp: 128, DispWidth: Disp8},
+				},
+			},
+			Encoding{
+				Hex:            "62f1d54b584002",
+				Iform:          "VADDPD_ZMMf64_MASKmskw_ZMMf64_MEMf64_AVX512",
+				TupleType:      "FULL",
+				DispScale:      64,
+				DispCompressed: true,
+			},
+		},
+
+		{
+			Inst{
+				Opcode: "VADDPD",
+				Params: []InstParam{ParamRexW1, ParamVexL512, ParamBroadcast},
+				Args: []Argument{
+					&reg{Name: "ZMM0"},
+					&reg{Name: "K3"},
+					&reg{Name: "ZMM5"},
+					&mem{Base: "RAX", Width: 64, Disp: 8, DispWidth: Disp8},
+				},
+			},
+			Encoding{
+				Hex:            "62f1d55b584001",
+				Iform:          "VADDPD_ZMMf64_MASKmskw_ZMMf64_MEMf64_AVX512",
+				TupleType:      "FULL",
+				DispScale:      8,
+				DispCompressed: true,
+			},
+		},
+
+		{
+			Inst{
+				Opcode: "VADDPD",
+				Params: []InstParam{ParamRexW1, ParamVexL512},
+				Args: []Argument{
+					&reg{Name: "ZMM0"},
+					&reg{Name: "K3"},
+					&reg{Name: "ZMM5"},
+					&mem{Base: "RAX", Width: 512, Disp: 65, DispWidth: Disp32},
+				},
+			},
+			Encoding{
+				Hex:            "62f1d54b588041000000",
+				Iform:          "VADDPD_ZMMf64_MASKmskw_ZMMf64_MEMf64_AVX512",
+				TupleType:      "FULL",
+				DispScale:      64,
+				DispCompressed: false,
+			},
+		},
+
+		// Gather/scatter N is an element size, not a vector size.
+		{
+			Inst{
+				Opcode: "VGATHERDPD",
+				Params: []InstParam{ParamRexW1, ParamVexL512},
+				Args: []Argument{
+					&reg{Name: "ZMM1"},
+					&reg{Name: "K1"},
+					&mem{Base: "RAX", Index: "YMM2", Scale: 8, Width: 64, Disp: 64, DispWidth: Disp8},
+				},
+			},
+			Encoding{
+				Hex:            "62f2fd49924cd008",
+				Iform:          "VGATHERDPD_ZMMf64_MASKmskw_MEMf64_AVX512_VL512",
+				TupleType:      "GSCAT",
+				DispScale:      8,
+				DispCompressed: true,
+			},
+		},
+
+		{
+			Inst{
+				Opcode: "VPSCATTERDD",
+				Params: []InstParam{ParamRexW0, ParamVexL512},
+				Args: []Argument{
+					&mem{Base: "RAX", Index: "ZMM2", Scale: 4, Width: 32, Disp: 64, DispWidth: Disp8},
+					&reg{Name: "K1"},
+					&reg{Name: "ZMM1"},
+				},
+			},
+			Encoding{
+				Hex:            "62f27d49a04c9010",
+				Iform:          "VPSCATTERDD_MEMu32_MASKmskw_ZMMu32_AVX512_VL512",
+				TupleType:      "GSCAT",
+				DispScale:      4,
+				DispCompressed: true,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		have, err := Encode(&test.inst)
+		if err != nil {
+			t.Errorf("encoding failed: %v", err)
+			continue
+		}
+		if *have != test.want {
+			t.Errorf("encoding result mismatch:\nhave: %+v\nwant: %+v",
+				*have, test.want)
+		}
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	type reg = RegArgument
+	type imm = ImmArgument
+	type mem = MemArgument
+
+	isUnknownOpcode := func(err error) bool {
+		return errors.Is(err, ErrUnknownOpcode)
+	}
+	isUnknownRegister := func(name string) func(error) bool {
+		return func(err error) bool {
+			var e *ErrUnknownRegister
+			return errors.As(err, &e) && e.Name == name
+		}
+	}
+	isBadOperand := func(index int) func(error) bool {
+		return func(err error) bool {
+			var e *ErrBadOperand
+			return errors.As(err, &e) && e.Index == index
+		}
+	}
+	isXED := func(err error) bool {
+		var e *ErrXED
+		return errors.As(err, &e)
+	}
+
+	tests := []struct {
+		inst  Inst
+		check func(error) bool
+	}{
+		{Inst{Opcode: "BADOP"}, isUnknownOpcode},
+
+		{
+			Inst{
+				Opcode: "INC",
+				Args:   []Argument{&reg{Name: "EAXX"}},
+			},
+			isUnknownRegister("EAXX"),
+		},
+
+		{
+			Inst{
+				Opcode: "VAESDEC",
+				Args: []Argument{
+					&reg{Name: "XMM11"},
+					&reg{Name: "XMM12"},
+					&mem{Base: "RDX", Index: "R88", Width: 128},
+				},
+			},
+			isBadOperand(2),
+		},
+
+		{
+			Inst{
+				Opcode: "ADD",
+				Args: []Argument{
+					&reg{Name: "EAX"},
+					&imm{Value: 1, Width: 24},
+				},
+			},
+			isBadOperand(1),
+		},
+
+		{
+			Inst{
+				Opcode: "ENTER",
+				Args: []Argument{
+					&imm{Value: 0x10, Width: 16, Unsigned: true},
+					&imm{Value: 0x01, Width: 16, Unsigned: true},
+				},
+			},
+			isBadOperand(1),
+		},
+
+		{
+			Inst{
+				Opcode: "EXTRQ",
+				Args: []Argument{
+					&reg{Name: "XMM1"},
+					&imm{Value: 0x02, Width: 8, Unsigned: true},
+					&imm{Value: 0x03, Width: 8, Unsigned: true},
+					&imm{Value: 0x04, Width: 8, Unsigned: true},
+				},
+			},
+			isBadOperand(3),
+		},
+
+		{
+			Inst{
+				Opcode: "JMP",
+				Args: []Argument{
+					&RelArgument{Width: 64},
+				},
+			},
+			isBadOperand(0),
+		},
+
+		{
+			Inst{
+				Opcode: "INC",
+				Args: []Argument{
+					&reg{Name: "XMM0"},
+				},
+			},
+			isXED,
+		},
+
+		{
+			// Far pointers are invalid in 64-bit mode.
+			Inst{
+				Opcode: "JMP_FAR",
+				Args: []Argument{
+					&PtrArgument{Width: 32, Selector: 0x10},
+				},
+			},
+			isXED,
+		},
+	}
+
+	for _, test := range tests {
+		_, err := ToHexString(&test.inst)
+		if err == nil {
+			t.Errorf("%s: expected error", test.inst.Opcode)
+			continue
+		}
+		if !test.check(err) {
+			t.Errorf("%s: unexpected error: %v", test.inst.Opcode, err)
+		}
+	}
+}
+
+func TestXEDEncoder(t *testing.T) {
+	type reg = RegArgument
+	type mem = MemArgument
+
+	var encoder Encoder = &XEDEncoder{}
+	describer, ok := encoder.(Describer)
+	if !ok {
+		t.Fatalf("XEDEncoder does not implement Describer")
+	}
+
+	insts := []*Inst{
+		{Opcode: "NOP"},
+		{
+			Opcode: "VADDPD",
+			Params: []InstParam{ParamRexW1, ParamVexL512},
+			Args: []Argument{
+				&reg{Name: "ZMM0"},
+				&reg{Name: "K3"},
+				&reg{Name: "ZMM5"},
+				&mem{Base: "RAX", Width: 512, Disp: 128, DispWidth: Disp8},
+			},
+		},
+	}
+
+	for _, inst := range insts {
+		code, err := encoder.Encode(inst)
+		if err != nil {
+			t.Errorf("%s: encoding failed: %v", inst.Opcode, err)
+			continue
+		}
+		want, err := Encode(inst)
+		if err != nil {
+			t.Errorf("%s: encoding failed: %v", inst.Opcode, err)
+			continue
+		}
+		have, err := describer.Describe(code)
+		if err != nil {
+			t.Errorf("%s: describe failed: %v", inst.Opcode, err)
+			continue
+		}
+		if *have != *want {
+			t.Errorf("%s: encoding result mismatch:\nhave: %+v\nwant: %+v",
+				inst.Opcode, *have, *want)
+		}
+	}
+}
+
+// batchTestInsts is a mix of encodable and invalid instructions.
+var batchTestInsts = []*Inst{
+	{Opcode: "NOP"},
+	{Opcode: "BADOP"},
+	{
+		Opcode: "ADD",
+		Args: []Argument{
+			&RegArgument{Name: "EAX"},
+			&ImmArgument{Value: 0x10, Width: 8},
+		},
+	},
+	{
+		Opcode: "INC",
+		Args:   []Argument{&RegArgument{Name: "XMM0"}},
+	},
+	{
+		Opcode: "VADDPD",
+		Params: []InstParam{ParamRexW1, ParamVexL512, ParamBroadcast},
+		Args: []Argument{
+			&RegArgument{Name: "ZMM0"},
+			&RegArgument{Name: "K3"},
+			&RegArgument{Name: "ZMM5"},
+			&MemArgument{Base: "RAX", Width: 64, Disp: 8, DispWidth: Disp8},
+		},
+	},
+	{
+		Opcode: "VAESDEC",
+		Args: []Argument{
+			&RegArgument{Name: "XMM11"},
+			&RegArgument{Name: "XMM12"},
+			&MemArgument{Base: "RDX", Index: "R88", Width: 128},
+		},
+	},
+	{
+		Opcode: "KORD",
+		Params: []InstParam{ParamRexW1, ParamVexL256},
+		Args: []Argument{
+			&RegArgument{Name: "K6"},
+			&RegArgument{Name: "K1"},
+			&RegArgument{Name: "K3"},
+		},
+	},
+}
+
+func TestEncodeBatch(t *testing.T) {
+	codes, errs := EncodeBatch(batchTestInsts)
+	if len(codes) != len(batchTestInsts) || len(errs) != len(batchTestInsts) {
+		t.Fatalf("results count mismatch: %d codes, %d errors", len(codes), len(errs))
+	}
+
+	var enc XEDEncoder
+	for i, inst := range batchTestInsts {
+		wantCode, wantErr := enc.Encode(inst)
+		if fmt.Sprint(errs[i]) != fmt.Sprint(wantErr) {
+			t.Errorf("%s: error mismatch:\nhave: %v\nwant: %v", inst.Opcode, errs[i], wantErr)
+		}
+		if !bytes.Equal(codes[i], wantCode) {
+			t.Errorf("%s: code mismatch:\nhave: %x\nwant: %x", inst.Opcode, codes[i], wantCode)
+		}
+	}
+
+	codes, errs = EncodeBatch(nil)
+	if len(codes) != 0 || len(errs) != 0 {
+		t.Errorf("empty batch: unexpected results")
+	}
+}
+
+func TestEncodeDescribeBatch(t *testing.T) {
+	var enc XEDEncoder
+	encs, errs := enc.EncodeDescribeBatch(batchTestInsts)
+	if len(encs) != len(batchTestInsts) || len(errs) != len(batchTestInsts) {
+		t.Fatalf("results count mismatch: %d encodings, %d errors", len(encs), len(errs))
+	}
+
+	for i, inst := range batchTestInsts {
+		code, wantErr := enc.Encode(inst)
+		if fmt.Sprint(errs[i]) != fmt.Sprint(wantErr) {
+			t.Errorf("%s: error mismatch:\nhave: %v\nwant: %v", inst.Opcode, errs[i], wantErr)
+			continue
+		}
+		if wantErr != nil {
+			continue
+		}
+		want, err := enc.Describe(code)
+		if err != nil {
+			t.Errorf("%s: describe: %v", inst.Opcode, err)
+			continue
+		}
+		if *encs[i] != *want {
+			t.Errorf("%s: encoding mismatch:\nhave: %+v\nwant: %+v", inst.Opcode, *encs[i], *want)
+		}
+	}
+}
+
+// TestEncodeConcurrent checks that XED can be used from several
+// goroutines and gives the same results as sequential encoding.
+func TestEncodeConcurrent(t *testing.T) {
+	wantCodes, wantErrs := EncodeBatch(batchTestInsts)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var enc XEDEncoder
+			for j, inst := range batchTestInsts {
+				code, err := enc.Encode(inst)
+				if fmt.Sprint(err) != fmt.Sprint(wantErrs[j]) || !bytes.Equal(code, wantCodes[j]) {
+					t.Errorf("%s: result mismatch: %x, %v", inst.Opcode, code, err)
+					continue
+				}
+				if err == nil {
+					if _, err := enc.Describe(code); err != nil {
+						t.Errorf("%s: describe: %v", inst.Opcode, err)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestEncoderModes(t *testing.T) {
+	inst := &Inst{
+		Opcode: "INC",
+		Params: []InstParam{ParamEOSZ32},
+		Args:   []Argument{&RegArgument{Name: "EAX"}},
+	}
+	tests := []struct {
+		mode MachineMode
+		want string
+	}{
+		{Mode64, "ffc0"},
+		{Mode32, "40"},
+		{Mode16, "6640"},
+	}
+
+	// Encoders with different modes are used concurrently
+	// to check that they don't share the state.
+	var wg sync.WaitGroup
+	for _, test := range tests {
+		enc, err := New(Options{Mode: test.mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := test.want
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				code, err := enc.Encode(inst)
+				if err != nil {
+					t.Errorf("%d-bit mode: %v", enc.Options().Mode.Bits(), err)
+					return
+				}
+				if have := fmt.Sprintf("%x", code); have != want {
+					t.Errorf("%d-bit mode:\nhave: %s\nwant: %s", enc.Options().Mode.Bits(), have, want)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestEncodeBranches(t *testing.T) {
+	type rel = RelArgument
+	type ptr = PtrArgument
+
+	tests := []struct {
+		mode MachineMode
+		inst Inst
+		want string
+	}{
+		{
+			Mode64,
+			Inst{
+				Opcode: "JMP",
+				Params: []InstParam{ParamEOSZ64},
+				Args:   []Argument{&rel{Width: 8, Offset: 0x10}},
+			},
+			"eb10",
+		},
+
+		{
+			Mode64,
+			Inst{
+				Opcode: "JMP",
+				Params: []InstParam{ParamEOSZ64},
+				Args:   []Argument{&rel{Width: 32, Offset: -16}},
+			},
+			"e9f0ffffff",
+		},
+
+		{
+			Mode64,
+			Inst{
+				Opcode: "JNE",
+				Params: []InstParam{ParamEOSZ64},
+				Args:   []Argument{&rel{Width: 32, Label: "target"}},
+			},
+			"0f8500000000",
+		},
+
+		{
+			Mode64,
+			Inst{
+				Opcode: "CALL",
+				Params: []InstParam{ParamEOSZ64},
+				Args:   []Argument{&rel{Width: 32, Offset: 0x100}},
+			},
+			"e800010000",
+		},
+
+		{
+			Mode32,
+			Inst{
+				Opcode: "JA",
+				Args:   []Argument{&rel{Width: 8, Offset: -2}},
+			},
+			"77fe",
+		},
+
+		{
+			Mode32,
+			Inst{
+				Opcode: "JMP_FAR",
+				Args:   []Argument{&ptr{Width: 32, Selector: 0x1234, Offset: 0x10}},
+			},
+			"ea100000003412",
+		},
+
+		{
+			Mode32,
+			Inst{
+				Opcode: "CALL_FAR",
+				Params: []InstParam{ParamEOSZ16},
+				Args:   []Argument{&ptr{Width: 16, Selector: 0x8, Offset: 0x20}},
+			},
+			"669a20000800",
+		},
+	}
+
+	for _, test := range tests {
+		enc, err := New(Options{Mode: test.mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, err := enc.Encode(&test.inst)
+		if err != nil {
+			t.Errorf("%s: encoding failed: %v", InstKey(&test.inst), err)
+			continue
+		}
+		if have := fmt.Sprintf("%x", code); have != test.want {
+			t.Errorf("%s:\nhave: %s\nwant: %s", InstKey(&test.inst), have, test.want)
+		}
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		for _, inst := range batchTestInsts {
+			ToHexString(inst)
+		}
+	}
+}
+
+func BenchmarkEncodeBatch(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		EncodeBatch(batchTestInsts)
+	}
+}
+
+func BenchmarkEncodeDescribe(b *testing.B) {
+	var enc XEDEncoder
+	for i := 0; i < b.N; i++ {
+		for _, inst := range batchTestInsts {
+			code, err := enc.Encode(inst)
+			if err == nil {
+				enc.Describe(code)
+			}
+		}
+	}
+}
+
+func BenchmarkEncodeDescribeBatch(b *testing.B) {
+	var enc XEDEncoder
+	for i := 0; i < b.N; i++ {
+		enc.EncodeDescribeBatch(batchTestInsts)
+	}
+}
@@ -2,3 +2,156 @@
 
 #include <xed/xed-interface.h>
 #include <stdint.h>
+#include <stdlib.h>
+
+// Batch encoding API.
+//
+// Requests are filled on the Go side without any XED calls,
+// then the whole batch is encoded (and, optionally, described)
+// by a single cgo call.
+
+enum {
+    AVX512TEST_OP_REG = 1,
+    AVX512TEST_OP_IMM,
+    AVX512TEST_OP_SIMM,
+    AVX512TEST_OP_MEM,
+    AVX512TEST_OP_IMM1,
+    AVX512TEST_OP_RELBR,
+    AVX512TEST_OP_PTR, // Expands into XED PTR and IMM0 (selector) operands
+};
+
+// avx512test_operand_t is a flat description of xed_encoder_operand_t.
+typedef struct {
+    int kind;
+    xed_reg_enum_t reg; // Register or memory base
+    xed_reg_enum_t index;
+    xed_uint_t scale;
+    xed_uint_t width; // Immediate or memory operand width in bits
+    xed_uint64_t imm; // IMM0 or IMM1 value, far pointer selector
+    xed_int64_t disp; // Memory, branch or far pointer displacement
+    xed_uint_t disp_bits;
+} avx512test_operand_t;
+
+// avx512test_description_t holds details of the decoded instruction.
+typedef struct {
+    xed_error_enum_t err; // Decoding error
+    xed_iform_enum_t iform;
+    xed_attribute_enum_t tuple; // XED_ATTRIBUTE_INVALID if not disp8*N encoded
+    xed_uint_t disp_scale;
+    int disp_compressed;
+} avx512test_description_t;
+
+static void avx512test_describe(const xed_state_t *state, const xed_uint8_t *code, unsigned int len, avx512test_description_t *d) {
+    xed_decoded_inst_t xedd;
+    xed_decoded_inst_zero_set_mode(&xedd, state);
+    d->err = xed_decode(&xedd, code, len);
+    if (d->err != XED_ERROR_NONE) {
+        return;
+    }
+
+    d->iform = xed_decoded_inst_get_iform_enum(&xedd);
+    d->tuple = XED_ATTRIBUTE_INVALID;
+    for (int attr = XED_ATTRIBUTE_DISP8_EIGHTHMEM; attr <= XED_ATTRIBUTE_DISP8_TUPLE8; attr++) {
+        if (xed_decoded_inst_get_attribute(&xedd, (xed_attribute_enum_t)attr)) {
+            d->tuple = (xed_attribute_enum_t)attr;
+            break;
+        }
+    }
+
+    if (d->tuple != XED_ATTRIBUTE_INVALID && xed_decoded_inst_number_of_memory_operands(&xedd) != 0) {
+        if (d->tuple == XED_ATTRIBUTE_DISP8_GSCAT) {
+            // Gather/scatter displacement is scaled by a single element size.
+            d->disp_scale = xed3_operand_get_element_size(&xedd) / 8;
+        } else {
+            // This is how XED computes disp8*N scaling factor during decoding.
+            d->disp_scale = (xed3_operand_get_nelem(&xedd) * xed3_operand_get_element_size(&xedd)) / 8;
+        }
+        d->disp_compressed = xed3_operand_get_disp_width(&xedd) == 8;
+    }
+}
+
+typedef struct {
+    // Input. Requests with XED_ICLASS_INVALID are skipped.
+    xed_iclass_enum_t iclass;
+    xed_uint_t eosz;
+    int rexw; // -1 if not set
+    int vl;   // -1 if not set
+    int bcst;
+    int describe; // Whether non-empty code should be described
+    xed_uint_t nops;
+    // Note that every PTR operand takes two XED operands.
+    avx512test_operand_t ops[XED_ENCODER_OPERANDS_MAX];
+
+    // Output.
+    xed_uint8_t code[XED_MAX_INSTRUCTION_BYTES];
+    unsigned int code_len;
+    xed_error_enum_t err;
+    int convert_failed;
+    avx512test_description_t desc;
+} avx512test_request_t;
+
+static void avx512test_encode_batch(const xed_state_t *state, avx512test_request_t *reqs, int n) {
+    for (int i = 0; i < n; i++) {
+        avx512test_request_t *r = &reqs[i];
+        if (r->iclass == XED_ICLASS_INVALID) {
+            continue;
+        }
+
+        xed_encoder_operand_t ops[XED_ENCODER_OPERANDS_MAX];
+        xed_uint_t nops = 0;
+        for (xed_uint_t j = 0; j < r->nops; j++) {
+            const avx512test_operand_t *op = &r->ops[j];
+            switch (op->kind) {
+            case AVX512TEST_OP_REG:
+                ops[nops++] = xed_reg(op->reg);
+                break;
+            case AVX512TEST_OP_IMM:
+                ops[nops++] = xed_imm0(op->imm, op->width);
+                break;
+            case AVX512TEST_OP_SIMM:
+                ops[nops++] = xed_simm0((xed_int32_t)op->imm, op->width);
+                break;
+            case AVX512TEST_OP_IMM1:
+                ops[nops++] = xed_imm1((xed_uint8_t)op->imm);
+                break;
+            case AVX512TEST_OP_MEM: {
+                xed_enc_displacement_t disp;
+                disp.displacement = (xed_uint64_t)op->disp;
+                disp.displacement_bits = op->disp_bits;
+                ops[nops++] = xed_mem_bisd(op->reg, op->index, op->scale, disp, op->width);
+                break;
+            }
+            case AVX512TEST_OP_RELBR:
+                ops[nops++] = xed_relbr((xed_int32_t)op->disp, op->width);
+                break;
+            case AVX512TEST_OP_PTR:
+                ops[nops++] = xed_ptr((xed_int32_t)op->disp, op->width);
+                ops[nops++] = xed_imm0(op->imm, 16);
+                break;
+            }
+        }
+
+        xed_encoder_instruction_t enc;
+        xed_inst(&enc, *state, r->iclass, r->eosz, nops, ops);
+
+        xed_encoder_request_t req;
+        xed_encoder_request_zero_set_mode(&req, &enc.mode);
+        if (!xed_convert_to_encoder_request(&req, &enc)) {
+            r->convert_failed = 1;
+            continue;
+        }
+        if (r->rexw >= 0) {
+            xed3_operand_set_rexw(&req, (xed_bits_t)r->rexw);
+        }
+        if (r->vl >= 0) {
+            xed3_operand_set_vl(&req, (xed_bits_t)r->vl);
+        }
+        if (r->bcst) {
+            xed3_operand_set_bcrc(&req, 1);
+        }
+        r->err = xed_encode(&req, r->code, XED_MAX_INSTRUCTION_BYTES, &r->code_len);
+        if (r->describe && r->err == XED_ERROR_NONE && r->code_len != 0) {
+            avx512test_describe(state, r->code, r->code_len, &r->desc);
+        }
+    }
+}
@@ -1,3 +1,6 @@
+//go:build cgo
+// +build cgo
+
 package x86encode
 
 // #cgo LDFLAGS: -lxed
@@ -6,198 +9,447 @@ import "C"
 import (
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"unsafe"
 )
 
-var xedState C.xed_state_t
+// xedMachine is an XED state of a single XEDEncoder.
+// It's never modified after newXEDMachine returns.
+type xedMachine struct {
+	state C.xed_state_t
+
+	// eosz is a default effective operand size.
+	eosz C.xed_uint_t
+}
+
+func newXEDMachine(opts *Options) *xedMachine {
+	xedTablesInit()
+
+	m := xedMachine{eosz: 32}
+	C.xed_state_zero(&m.state)
+	switch opts.Mode {
+	case Mode64:
+		m.state.mmode = C.XED_MACHINE_MODE_LONG_64
+	case Mode32:
+		m.state.mmode = C.XED_MACHINE_MODE_LEGACY_32
+	case Mode16:
+		m.state.mmode = C.XED_MACHINE_MODE_LEGACY_16
+		m.eosz = 16
+	}
+	switch opts.addressWidth() {
+	case 16:
+		m.state.stack_addr_width = C.XED_ADDRESS_WIDTH_16b
+	case 32:
+		m.state.stack_addr_width = C.XED_ADDRESS_WIDTH_32b
+	case 64:
+		m.state.stack_addr_width = C.XED_ADDRESS_WIDTH_64b
+	}
+	return &m
+}
+
+var (
+	xedTablesOnce sync.Once
+
+	// xedIformNames maps XED iform enum values to their names.
+	xedIformNames []string
+
+	// xedTupleTypes maps XED disp8*N attributes to tuple type names.
+	xedTupleTypes map[C.xed_attribute_enum_t]string
+)
+
+// xedTablesInit initializes XED tables on the first call.
+// XED tables are shared by all xed_state_t objects. After the
+// initialization, XED encoder and decoder only read the tables
+// and the state, so they can be used from several goroutines.
+//
+// Enum names that are reported by describe are also cached here,
+// so describing an instruction does not need extra cgo calls.
+func xedTablesInit() {
+	xedTablesOnce.Do(func() {
+		C.xed_tables_init()
+
+		xedIformNames = make([]string, C.XED_IFORM_LAST)
+		for i := range xedIformNames {
+			xedIformNames[i] = C.GoString(C.xed_iform_enum_t2str(C.xed_iform_enum_t(i)))
+		}
+		xedTupleTypes = map[C.xed_attribute_enum_t]string{}
+		for attr := C.XED_ATTRIBUTE_DISP8_EIGHTHMEM; attr <= C.XED_ATTRIBUTE_DISP8_TUPLE8; attr++ {
+			name := C.GoString(C.xed_attribute_enum_t2str(C.xed_attribute_enum_t(attr)))
+			xedTupleTypes[C.xed_attribute_enum_t(attr)] = strings.TrimPrefix(name, "DISP8_")
+		}
+	})
+}
+
+func xedVersion() string { return C.GoString(C.xed_get_version()) }
+
+func (m *xedMachine) encode(inst *Inst) ([]byte, error) {
+	codes, errs := m.encodeBatch([]*Inst{inst})
+	return codes[0], errs[0]
+}
+
+// encodeBatch encodes insts with a single cgo call.
+func (m *xedMachine) encodeBatch(insts []*Inst) ([][]byte, []error) {
+	codes := make([][]byte, len(insts))
+	errs := make([]error, len(insts))
+	m.runBatch(insts, false, func(i int, req *C.avx512test_request_t, err error) {
+		if err != nil {
+			errs[i] = err
+			return
+		}
+		codes[i] = C.GoBytes(unsafe.Pointer(&req.code[0]), C.int(req.code_len))
+	})
+	return codes, errs
+}
 
-func init() {
-	C.xed_state_zero(&xedState)
-	xedState.stack_addr_width = C.XED_ADDRESS_WIDTH_64b
-	xedState.mmode = C.XED_MACHINE_MODE_LONG_64
+// encodeDescribeBatch is like encodeBatch followed by describe
+// for every non-empty code, but it only makes a single cgo call.
+// Empty codes are reported as encodings with empty Hex.
+func (m *xedMachine) encodeDescribeBatch(insts []*Inst) ([]*Encoding, []error) {
+	encs := make([]*Encoding, len(insts))
+	errs := make([]error, len(insts))
+	m.runBatch(insts, true, func(i int, req *C.avx512test_request_t, err error) {
+		if err != nil {
+			errs[i] = err
+			return
+		}
+		code := C.GoBytes(unsafe.Pointer(&req.code[0]), C.int(req.code_len))
+		if len(code) == 0 {
+			encs[i] = &Encoding{}
+			return
+		}
+		encs[i], errs[i] = xedEncoding(code, &req.desc)
+	})
+	return encs, errs
 }
 
-func xedTablesInit() { C.xed_tables_init() }
+// runBatch encodes insts with a single cgo call and passes every
+// request to visit along with its error. If err is not nil,
+// the request output should not be used.
+//
+// Requests are marshaled into C memory that is allocated once per batch.
+// If describe is true, successfully encoded requests are also decoded.
+func (m *xedMachine) runBatch(insts []*Inst, describe bool, visit func(i int, req *C.avx512test_request_t, err error)) {
+	if len(insts) == 0 {
+		return
+	}
+
+	mem := C.calloc(C.size_t(len(insts)), C.size_t(unsafe.Sizeof(C.avx512test_request_t{})))
+	if mem == nil {
+		panic("x86encode: out of memory")
+	}
+	defer C.free(mem)
+	reqs := unsafe.Slice((*C.avx512test_request_t)(mem), len(insts))
+
+	errs := make([]error, len(insts))
+	for i, inst := range insts {
+		if err := xedMarshalRequest(&reqs[i], inst, m.eosz); err != nil {
+			errs[i] = err
+			reqs[i].iclass = C.XED_ICLASS_INVALID // Skip it
+		}
+		if describe {
+			reqs[i].describe = 1
+		}
+	}
+
+	C.avx512test_encode_batch(&m.state, &reqs[0], C.int(len(reqs)))
 
-func xedEncode(inst *Inst) ([]byte, error) {
-	const bufCapacity = C.XED_MAX_INSTRUCTION_BYTES
-	buf := make([]byte, bufCapacity)
+	for i := range reqs {
+		req := &reqs[i]
+		switch {
+		case errs[i] != nil:
+			// Already failed.
+		case req.convert_failed != 0:
+			errs[i] = errors.New("encoder request conversion failed")
+		case req.err != C.XED_ERROR_NONE:
+			errs[i] = xedError(req.err)
+		}
+		visit(i, req, errs[i])
+	}
+}
 
-	var enc C.xed_encoder_instruction_t
-	eosz := C.xed_uint_t(32) // Default
+// xedOpcodeAliases maps Intel branch mnemonics to the
+// XED iclass names of the same instructions.
+var xedOpcodeAliases = map[string]string{
+	"CALL": "CALL_NEAR",
+	"JA":   "JNBE",
+	"JAE":  "JNB",
+	"JC":   "JB",
+	"JE":   "JZ",
+	"JG":   "JNLE",
+	"JGE":  "JNL",
+	"JNA":  "JBE",
+	"JNAE": "JB",
+	"JNC":  "JNB",
+	"JNE":  "JNZ",
+	"JNG":  "JLE",
+	"JNGE": "JL",
+	"JPE":  "JP",
+	"JPO":  "JNP",
+}
 
-	iclass := C.xed_iclass_enum_t(iclassByOpcode[inst.Opcode])
+// xedMarshalRequest fills req with inst encoding request data.
+// Effective operand size is eosz unless it's set by inst params.
+func xedMarshalRequest(req *C.avx512test_request_t, inst *Inst, eosz C.xed_uint_t) error {
+	opcode := inst.Opcode
+	if alias := xedOpcodeAliases[opcode]; alias != "" {
+		opcode = alias
+	}
+	iclass := C.xed_iclass_enum_t(iclassByOpcode[opcode])
 	if iclass == 0 {
-		panic(fmt.Sprintf("no iclass found for %q", inst.Opcode))
+		return fmt.Errorf("%w: %q", ErrUnknownOpcode, inst.Opcode)
+	}
+	nops := len(inst.Args)
+	for _, arg := range inst.Args {
+		if _, ok := arg.(*PtrArgument); ok {
+			nops++ // Selector is passed as a separate XED operand
+		}
+	}
+	if nops > len(req.ops) {
+		return fmt.Errorf("unexpected number of args: %d", len(inst.Args))
 	}
 
+	req.iclass = iclass
+	req.eosz = eosz
+	req.rexw = -1
+	req.vl = -1
 	for _, param := range inst.Params {
 		switch param {
 		case ParamEOSZ8:
-			eosz = 8
+			req.eosz = 8
 		case ParamEOSZ16:
-			eosz = 16
+			req.eosz = 16
 		case ParamEOSZ32:
-			eosz = 32
+			req.eosz = 32
 		case ParamEOSZ64:
-			eosz = 64
-		}
-	}
-
-	operands, err := xedConvertOperands(inst)
-	if err != nil {
-		return nil, err
-	}
-
-	switch len(inst.Args) {
-	case 0:
-		C.xed_inst0(&enc, xedState, iclass, eosz)
-	case 1:
-		C.xed_inst1(&enc, xedState, iclass, eosz,
-			operands[0])
-	case 2:
-		C.xed_inst2(&enc, xedState, iclass, eosz,
-			operands[0],
-			operands[1])
-	case 3:
-		C.xed_inst3(&enc, xedState, iclass, eosz,
-			operands[0],
-			operands[1],
-			operands[2])
-	case 4:
-		C.xed_inst4(&enc, xedState, iclass, eosz,
-			operands[0],
-			operands[1],
-			operands[2],
-			operands[3])
-	case 5:
-		C.xed_inst5(&enc, xedState, iclass, eosz,
-			operands[0],
-			operands[1],
-			operands[2],
-			operands[3],
-			operands[4])
-	default:
-		return nil, fmt.Errorf("unexpected number of args: %d", len(inst.Args))
-	}
+			req.eosz = 64
 
-	var req C.xed_encoder_request_t
-	C.xed_encoder_request_zero_set_mode(&req, &enc.mode)
-	ok := C.xed_convert_to_encoder_request(&req, &enc)
-	if ok == 0 {
-		return nil, errors.New("encoder request conversion failed")
-	}
-
-	for _, param := range inst.Params {
-		switch param {
 		case ParamRexW0:
-			C.xed3_operand_set_rexw(&req, C.xed_bits_t(0))
+			req.rexw = 0
 		case ParamRexW1:
-			C.xed3_operand_set_rexw(&req, C.xed_bits_t(1))
+			req.rexw = 1
 
 		case ParamVexL128:
-			C.xed3_operand_set_vl(&req, C.xed_bits_t(0))
+			req.vl = 0
 		case ParamVexL256:
-			C.xed3_operand_set_vl(&req, C.xed_bits_t(1))
+			req.vl = 1
 		case ParamVexL512:
-			C.xed3_operand_set_vl(&req, C.xed_bits_t(2))
+			req.vl = 2
+
+		case ParamBroadcast:
+			req.bcst = 1
+		}
+	}
+
+	req.nops = C.xed_uint_t(len(inst.Args))
+	nimm := 0 // Immediates marshaled so far
+	for i, arg := range inst.Args {
+		if err := xedMarshalOperand(&req.ops[i], arg, nimm); err != nil {
+			return &ErrBadOperand{Index: i, Err: err}
+		}
+		if _, ok := arg.(*ImmArgument); ok {
+			nimm++
 		}
 	}
+	return nil
+}
 
-	codeLen := C.uint(0)
-	errCode := C.xed_encode(
-		&req,
-		(*C.uint8_t)(unsafe.Pointer(&buf[0])),
-		C.uint(cap(buf)),
-		&codeLen,
+func (m *xedMachine) decode(xedd *C.xed_decoded_inst_t, code []byte) error {
+	if len(code) == 0 {
+		return errors.New("decode: empty input")
+	}
+	C.xed_decoded_inst_zero_set_mode(xedd, &m.state)
+	errCode := C.xed_decode(
+		xedd,
+		(*C.xed_uint8_t)(unsafe.Pointer(&code[0])),
+		C.uint(len(code)),
 	)
 	if errCode != C.XED_ERROR_NONE {
-		return nil, fmt.Errorf("xed error: %s", xedErrCodeToString(errCode))
+		return fmt.Errorf("decode: %w", xedError(errCode))
+	}
+	return nil
+}
+
+func (m *xedMachine) disassemble(code []byte, syntax Syntax) (string, error) {
+	var xedd C.xed_decoded_inst_t
+	if err := m.decode(&xedd, code); err != nil {
+		return "", err
+	}
+
+	xedSyntax := C.XED_SYNTAX_INTEL
+	if syntax == SyntaxATT {
+		xedSyntax = C.XED_SYNTAX_ATT
 	}
 
-	return buf[:codeLen], nil
+	const bufCapacity = 256
+	var buf [bufCapacity]C.char
+	ok := C.xed_format_context(C.xed_syntax_enum_t(xedSyntax), &xedd,
+		&buf[0], bufCapacity, 0, nil, nil)
+	if ok == 0 {
+		return "", errors.New("xed format failed")
+	}
+	return C.GoString(&buf[0]), nil
 }
 
-func xedConvertOperands(inst *Inst) ([]C.xed_encoder_operand_t, error) {
-	operands := make([]C.xed_encoder_operand_t, len(inst.Args))
-	for i, arg := range inst.Args {
-		op, err := xedOperand(arg)
-		if err != nil {
-			return nil, fmt.Errorf("error in Args[%d]: %v", i, err)
-		}
-		operands[i] = op
+func (m *xedMachine) describe(code []byte) (*Encoding, error) {
+	if len(code) == 0 {
+		return nil, errors.New("decode: empty input")
 	}
-	return operands, nil
+	var desc C.avx512test_description_t
+	C.avx512test_describe(
+		&m.state,
+		(*C.xed_uint8_t)(unsafe.Pointer(&code[0])),
+		C.uint(len(code)),
+		&desc,
+	)
+	return xedEncoding(code, &desc)
 }
 
-func xedOperand(arg Argument) (C.xed_encoder_operand_t, error) {
-	var invalid C.xed_encoder_operand_t
+// xedEncoding converts the description of code into Encoding.
+func xedEncoding(code []byte, desc *C.avx512test_description_t) (*Encoding, error) {
+	if desc.err != C.XED_ERROR_NONE {
+		return nil, fmt.Errorf("decode: %w", xedError(desc.err))
+	}
 
+	result := Encoding{
+		Hex:   fmt.Sprintf("%x", code),
+		Iform: xedIformNames[desc.iform],
+	}
+	if desc.tuple != C.XED_ATTRIBUTE_INVALID {
+		result.TupleType = xedTupleTypes[desc.tuple]
+		result.DispScale = int(desc.disp_scale)
+		result.DispCompressed = desc.disp_compressed != 0
+	}
+	return &result, nil
+}
+
+// xedMarshalOperand fills op with arg description.
+// nimm is a number of immediate operands that precede arg.
+func xedMarshalOperand(op *C.avx512test_operand_t, arg Argument, nimm int) error {
 	switch arg := arg.(type) {
 	case *RegArgument:
-		return C.xed_reg(C.xed_reg_enum_t(registerByName[arg.Name])), nil
+		reg, err := xedRegister(arg.Name)
+		if err != nil {
+			return err
+		}
+		op.kind = C.AVX512TEST_OP_REG
+		op.reg = reg
+		return nil
 
 	case *ImmArgument:
 		switch {
-		case arg.Width == 8 && arg.Unsigned:
-			return C.xed_imm0(C.xed_uint64_t(arg.Value), 8), nil
-		case arg.Width == 16 && arg.Unsigned:
-			return C.xed_imm0(C.xed_uint64_t(arg.Value), 16), nil
-		case arg.Width == 32 && arg.Unsigned:
-			return C.xed_imm0(C.xed_uint64_t(arg.Value), 32), nil
-		case arg.Width == 64 && arg.Unsigned:
-			return C.xed_imm0(C.xed_uint64_t(arg.Value), 64), nil
-		case arg.Width == 8 && !arg.Unsigned:
-			return C.xed_simm0(C.xed_int32_t(arg.Value), 8), nil
-		case arg.Width == 16 && !arg.Unsigned:
-			return C.xed_simm0(C.xed_int32_t(arg.Value), 16), nil
-		case arg.Width == 32 && !arg.Unsigned:
-			return C.xed_simm0(C.xed_int32_t(arg.Value), 32), nil
+		case nimm > 1:
+			return errors.New("too many immediate operands")
+		case nimm == 1 && arg.Width != 8:
+			return fmt.Errorf("second immediate should be 8-bit, got %d-bit", arg.Width)
+		case nimm == 1:
+			op.kind = C.AVX512TEST_OP_IMM1
+		case arg.Width == 64:
+			// 64-bit immediate is never extended,
+			// so its signedness does not matter.
+			op.kind = C.AVX512TEST_OP_IMM
+		case arg.Unsigned && (arg.Width == 8 || arg.Width == 16 || arg.Width == 32):
+			op.kind = C.AVX512TEST_OP_IMM
+		case !arg.Unsigned && (arg.Width == 8 || arg.Width == 16 || arg.Width == 32):
+			op.kind = C.AVX512TEST_OP_SIMM
 		default:
-			return invalid, errors.New("bad width/signedness combination for immediate")
+			return errors.New("bad width/signedness combination for immediate")
 		}
+		op.imm = C.xed_uint64_t(arg.Value)
+		op.width = C.xed_uint_t(arg.Width)
+		return nil
 
 	case *MemArgument:
-		var disp C.xed_enc_displacement_t
-		disp.displacement = C.xed_uint64_t(arg.Disp)
+		op.disp = C.xed_int64_t(arg.Disp)
 		switch arg.DispWidth {
 		case Disp8:
-			disp.displacement_bits = 8
+			op.disp_bits = 8
 		case Disp32:
-			disp.displacement_bits = 32
+			op.disp_bits = 32
 		case DispSmallest:
 			switch {
 			case arg.Disp == 0:
-				disp.displacement_bits = 0
+				op.disp_bits = 0
 			case arg.Disp >= -128 && arg.Disp <= 127:
-				disp.displacement_bits = 8
+				op.disp_bits = 8
 			default:
-				disp.displacement_bits = 32
+				op.disp_bits = 32
 			}
 		default:
-			return invalid, fmt.Errorf("invalid memory argument disp width: %d", arg.DispWidth)
+			return fmt.Errorf("invalid memory argument disp width: %d", arg.DispWidth)
 		}
 
-		scale := C.xed_uint_t(arg.Scale)
+		op.scale = C.xed_uint_t(arg.Scale)
 		switch arg.Scale {
 		case 0:
-			scale = 1 // Default
+			op.scale = 1 // Default
 		case 1, 2, 4, 8:
 			// OK.
 		default:
-			return invalid, fmt.Errorf("invalid memory argument scale: %d", arg.Scale)
+			return fmt.Errorf("invalid memory argument scale: %d", arg.Scale)
 		}
 
-		base := C.xed_reg_enum_t(registerByName[arg.Base])
-		index := C.xed_reg_enum_t(registerByName[arg.Index])
-		bitSize := C.xed_uint_t(arg.Width)
-		return C.xed_mem_bisd(base, index, scale, disp, bitSize), nil
+		base, err := xedRegister(arg.Base)
+		if err != nil {
+			return err
+		}
+		index, err := xedRegister(arg.Index)
+		if err != nil {
+			return err
+		}
+		op.kind = C.AVX512TEST_OP_MEM
+		op.reg = base
+		op.index = index
+		op.width = C.xed_uint_t(arg.Width)
+		return nil
+
+	case *RelArgument:
+		switch arg.Width {
+		case 8, 16, 32:
+			// OK.
+		default:
+			return fmt.Errorf("invalid branch displacement width: %d", arg.Width)
+		}
+		op.kind = C.AVX512TEST_OP_RELBR
+		op.disp = C.xed_int64_t(arg.Offset)
+		op.width = C.xed_uint_t(arg.Width)
+		return nil
+
+	case *PtrArgument:
+		switch arg.Width {
+		case 16, 32:
+			// OK.
+		default:
+			return fmt.Errorf("invalid far pointer offset width: %d", arg.Width)
+		}
+		op.kind = C.AVX512TEST_OP_PTR
+		op.disp = C.xed_int64_t(int32(arg.Offset))
+		op.imm = C.xed_uint64_t(arg.Selector)
+		op.width = C.xed_uint_t(arg.Width)
+		return nil
 
 	default:
-		return invalid, fmt.Errorf("invalid argument type: %T", arg)
+		return fmt.Errorf("invalid argument type: %T", arg)
 	}
 }
 
+// xedRegister returns XED register enum value for the given name.
+// Empty name is mapped to XED_REG_INVALID, which means "no register".
+func xedRegister(name string) (C.xed_reg_enum_t, error) {
+	if name == "" {
+		return C.XED_REG_INVALID, nil
+	}
+	id, ok := registerByName[name]
+	if !ok {
+		return C.XED_REG_INVALID, &ErrUnknownRegister{Name: name}
+	}
+	return C.xed_reg_enum_t(id), nil
+}
+
+func xedError(errCode C.xed_error_enum_t) error {
+	return &ErrXED{Code: int(errCode), Name: xedErrCodeToString(errCode)}
+}
+
 func xedErrCodeToString(errCode C.xed_error_enum_t) string {
 	return C.GoString(C.xed_error_enum_t2str(errCode))
 }
@@ -0,0 +1,42 @@
+//go:build !cgo
+// +build !cgo
+
+package x86encode
+
+import (
+	"errors"
+)
+
+// errNoXED is returned by XED-based functions when
+// the package is built without cgo.
+var errNoXED = errors.New("XED is unavailable: built without cgo")
+
+type xedMachine struct{}
+
+func newXEDMachine(opts *Options) *xedMachine { return &xedMachine{} }
+
+func xedVersion() string { return "" }
+
+func (m *xedMachine) encode(inst *Inst) ([]byte, error) { return nil, errNoXED }
+
+func (m *xedMachine) encodeBatch(insts []*Inst) ([][]byte, []error) {
+	errs := make([]error, len(insts))
+	for i := range errs {
+		errs[i] = errNoXED
+	}
+	return make([][]byte, len(insts)), errs
+}
+
+func (m *xedMachine) encodeDescribeBatch(insts []*Inst) ([]*Encoding, []error) {
+	errs := make([]error, len(insts))
+	for i := range errs {
+		errs[i] = errNoXED
+	}
+	return make([]*Encoding, len(insts)), errs
+}
+
+func (m *xedMachine) disassemble(code []byte, syntax Syntax) (string, error) {
+	return "", errNoXED
+}
+
+func (m *xedMachine) describe(code []byte) (*Encoding, error) { return nil, errNoXED }